@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+type _Adjacency map[string][]string
+
+func _GetAdjacency(def FSMDefinition) _Adjacency {
+	adjacency := _Adjacency{}
+	for _, eventName := range _GetEvents(def) {
+		event := def.Events[eventName]
+		for _, src := range event.Source {
+			if !slices.Contains(adjacency[src], event.Destination) {
+				adjacency[src] = append(adjacency[src], event.Destination)
+			}
+		}
+	}
+	return adjacency
+}
+
+func (adjacency _Adjacency) Reversed() _Adjacency {
+	reversed := _Adjacency{}
+	for src, dests := range adjacency {
+		for _, dest := range dests {
+			reversed[dest] = append(reversed[dest], src)
+		}
+	}
+	return reversed
+}
+
+func (adjacency _Adjacency) Reachable(start string) map[string]bool {
+	reached := map[string]bool{start: true}
+	queue := []string{start}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		for _, next := range adjacency[state] {
+			if !reached[next] {
+				reached[next] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+	return reached
+}
+
+// CheckNoReturn lists the states from which InitialState can never be
+// reached again. States of a region are checked against its InitialState.
+func CheckNoReturn(definition FSMDefinition) ([]Finding, error) {
+	if definition.InitialState == "" {
+		return nil, fmt.Errorf("checking for states with no return needs InitialState to be set")
+	}
+
+	reversed := _GetAdjacency(definition).Reversed()
+	regions := _GetStateRegions(definition)
+
+	warnings := []Finding{}
+	for _, state := range _GetStates(definition) {
+		initialState := _GetInitialState(definition, regions[state])
+		if !reversed.Reachable(initialState)[state] {
+			warnings = append(warnings, Finding{
+				Severity: "warning",
+				Category: "no-return",
+				Message:  fmt.Sprintf("state %v has no path back to %v", state, initialState),
+				States:   []string{state, initialState},
+			})
+		}
+	}
+	return warnings, nil
+}
+
+// CheckFinalStatesReachable lists every FinalStates entry that can't be
+// reached from the InitialState of the machine or region it belongs to.
+// Without an InitialState there is nothing to check against.
+func CheckFinalStatesReachable(definition FSMDefinition) []Finding {
+	adjacency := _GetAdjacency(definition)
+	regions := _GetStateRegions(definition)
+
+	warnings := []Finding{}
+	for _, state := range definition.FinalStates {
+		initialState := _GetInitialState(definition, regions[state])
+		if initialState == "" {
+			continue
+		}
+		if !adjacency.Reachable(initialState)[state] {
+			warnings = append(warnings, Finding{
+				Severity: "warning",
+				Category: "unreachable-final-state",
+				Message:  fmt.Sprintf("final state %v is unreachable from %v", state, initialState),
+				States:   []string{state, initialState},
+			})
+		}
+	}
+	return warnings
+}
+
+// FindCycle returns the states of a cycle in the transition graph, in
+// order, or nil when there is none. Self-loops don't count as cycles.
+func FindCycle(definition FSMDefinition) []string {
+	adjacency := _GetAdjacency(definition)
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	color := map[string]int{}
+	stack := []string{}
+
+	var visit func(state string) []string
+	visit = func(state string) []string {
+		color[state] = visiting
+		stack = append(stack, state)
+		for _, next := range adjacency[state] {
+			if next == state {
+				continue
+			}
+			switch color[next] {
+			case visiting:
+				return slices.Clone(stack[slices.Index(stack, next):])
+			case unvisited:
+				if cycle := visit(next); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		color[state] = done
+		return nil
+	}
+
+	for _, state := range _GetStates(definition) {
+		if color[state] == unvisited {
+			if cycle := visit(state); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func _Messages(findings []Finding) []string {
+	messages := []string{}
+	for _, finding := range findings {
+		messages = append(messages, finding.Message)
+	}
+	return messages
+}
+
+func TestCheckNoReturn(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML+`
+[Events.Reopen]
+Source = ["Cancelled"]
+Destination = "Pending"
+`)
+
+	warnings, err := CheckNoReturn(definition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"state Shipped has no path back to Pending"}
+	if got := _Messages(warnings); !slices.Equal(got, want) {
+		t.Fatal(got)
+	}
+
+	definition.InitialState = ""
+	if _, err := CheckNoReturn(definition); err == nil {
+		t.Fatal("checked without an InitialState")
+	}
+}
+
+func TestCheckFinalStatesReachable(t *testing.T) {
+	definition := _Parse(t, `FinalStates = ["Shipped", "Archived", "Cancelled"]`+_ORDER_TOML+`
+[Events.Archive]
+Source = ["Archived"]
+Destination = "Archived"
+`)
+	want := []string{"final state Archived is unreachable from Pending"}
+	if got := _Messages(CheckFinalStatesReachable(definition)); !slices.Equal(got, want) {
+		t.Fatal(got)
+	}
+}
+
+func TestFindCycle(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML+`
+[Events.Touch]
+Source = ["Approved"]
+Destination = "Approved"
+`)
+	if cycle := FindCycle(definition); cycle != nil {
+		t.Fatal("self-loops are allowed", cycle)
+	}
+	definition.Acyclic = true
+	if err := ValidateDefinition(definition); err != nil {
+		t.Fatal(err)
+	}
+
+	definition = _Parse(t, `Acyclic = true`+_ORDER_TOML+`
+[Events.Reopen]
+Source = ["Cancelled"]
+Destination = "Pending"
+`)
+	if cycle := FindCycle(definition); !slices.Equal(cycle, []string{"Approved", "Cancelled", "Pending"}) {
+		t.Fatal(cycle)
+	}
+	err := ValidateDefinition(definition)
+	if err == nil || err.Error() != "definition is marked Acyclic but has the cycle Approved -> Cancelled -> Pending -> Approved" {
+		t.Fatal(err)
+	}
+}
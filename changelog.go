@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+func _Added(before, after []string) []string {
+	added := []string{}
+	for _, name := range after {
+		if !slices.Contains(before, name) {
+			added = append(added, name)
+		}
+	}
+	return added
+}
+
+func _DescribeParams(params []FSMEventParams) string {
+	described := []string{}
+	for _, param := range params {
+		described = append(described, param.Name+" "+param.Type)
+	}
+	return "(" + strings.Join(described, ", ") + ")"
+}
+
+func _DescribeSources(sources []string) string {
+	sources = slices.Clone(sources)
+	slices.Sort(sources)
+	return strings.Join(sources, ", ")
+}
+
+// Changelog describes how after differs from before in terms of states,
+// transitions and params, grouped by category and sorted by name.
+func Changelog(before, after FSMDefinition) string {
+	oldStates, newStates := _GetStates(before), _GetStates(after)
+	oldEvents := slices.Sorted(maps.Keys(before.Events))
+	newEvents := slices.Sorted(maps.Keys(after.Events))
+
+	states := []string{}
+	for _, state := range _Added(oldStates, newStates) {
+		states = append(states, "added state "+state)
+	}
+	for _, state := range _Added(newStates, oldStates) {
+		states = append(states, "removed state "+state)
+	}
+
+	transitions := []string{}
+	params := []string{}
+	for _, eventName := range _Added(oldEvents, newEvents) {
+		event := after.Events[eventName]
+		transitions = append(transitions, fmt.Sprintf(
+			"added %v: %v -> %v", eventName, _DescribeSources(event.Source), event.Destination,
+		))
+	}
+	for _, eventName := range _Added(newEvents, oldEvents) {
+		transitions = append(transitions, "removed "+eventName)
+	}
+	for _, eventName := range newEvents {
+		oldEvent, ok := before.Events[eventName]
+		if !ok {
+			continue
+		}
+		newEvent := after.Events[eventName]
+
+		oldSources, newSources := _DescribeSources(oldEvent.Source), _DescribeSources(newEvent.Source)
+		if oldSources != newSources || oldEvent.Destination != newEvent.Destination {
+			transitions = append(transitions, fmt.Sprintf(
+				"changed %v: %v -> %v is now %v -> %v",
+				eventName, oldSources, oldEvent.Destination, newSources, newEvent.Destination,
+			))
+		}
+
+		oldParams, newParams := _DescribeParams(oldEvent.Params), _DescribeParams(newEvent.Params)
+		if oldParams != newParams {
+			params = append(params, fmt.Sprintf("changed %v%v to %v%v", eventName, oldParams, eventName, newParams))
+		}
+	}
+
+	builder := strings.Builder{}
+	for _, section := range []struct {
+		title   string
+		entries []string
+	}{
+		{"States", states},
+		{"Transitions", transitions},
+		{"Params", params},
+	} {
+		if len(section.entries) == 0 {
+			continue
+		}
+		fmt.Fprintf(&builder, "%v:\n", section.title)
+		for _, entry := range section.entries {
+			fmt.Fprintf(&builder, "  - %v\n", entry)
+		}
+	}
+
+	if builder.Len() == 0 {
+		return "No changes.\n"
+	}
+	return builder.String()
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestChangelog(t *testing.T) {
+	before := _Parse(t, _ORDER_TOML)
+	after := _Parse(t, strings.NewReplacer(
+		`Type = "string"`, `Type = "Carrier"`,
+		`Source = ["Pending", "Approved"]`, `Source = ["Pending"]`,
+	).Replace(_ORDER_TOML)+`
+[Events.Refund]
+Source = ["Shipped"]
+Destination = "Refunded"
+`)
+	delete(after.Events, "Approve")
+
+	want := `States:
+  - added state Refunded
+Transitions:
+  - added Refund: Shipped -> Refunded
+  - removed Approve
+  - changed Cancel: Approved, Pending -> Cancelled is now Pending -> Cancelled
+Params:
+  - changed Ship(carrier string) to Ship(carrier Carrier)
+`
+	if got := Changelog(before, after); got != want {
+		t.Fatalf("got\n%v\nwant\n%v", got, want)
+	}
+
+	if got := Changelog(before, before); got != "No changes.\n" {
+		t.Fatal(got)
+	}
+}
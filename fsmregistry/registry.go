@@ -0,0 +1,56 @@
+// Package fsmregistry collects the FSMs generated with Register = true so
+// tooling can enumerate every machine compiled into a binary.
+package fsmregistry
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+type Info struct {
+	Name string
+	// Package is the package name, which several packages can share.
+	Package string
+	// Path is the import path of the package, which identifies it.
+	Path   string
+	States []string
+	Events []string
+}
+
+var (
+	mu       sync.RWMutex
+	machines = map[string]Info{}
+)
+
+// Register is called from the init of generated code. Registering the same
+// import path and name twice panics, mirroring database/sql.Register.
+func Register(info Info) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	key := info.Path + "." + info.Name
+	if _, ok := machines[key]; ok {
+		panic(fmt.Sprintf("fsmregistry: %v registered twice", key))
+	}
+	machines[key] = info
+}
+
+// All returns every registered FSM sorted by import path then name.
+func All() []Info {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	infos := []Info{}
+	for _, info := range machines {
+		infos = append(infos, info)
+	}
+	slices.SortFunc(infos, func(a, b Info) int {
+		if c := strings.Compare(a.Path, b.Path); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	return infos
+}
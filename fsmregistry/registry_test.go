@@ -0,0 +1,31 @@
+package fsmregistry
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRegister(t *testing.T) {
+	Register(Info{Name: "OrderFSM", Package: "orders", Path: "example.com/b/orders", Events: []string{"Ship"}})
+	Register(Info{Name: "OrderFSM", Package: "orders", Path: "example.com/a/orders", Events: []string{"Approve"}})
+	Register(Info{Name: "CartFSM", Package: "orders", Path: "example.com/b/orders"})
+
+	paths := []string{}
+	for _, info := range All() {
+		paths = append(paths, info.Path+"."+info.Name)
+	}
+	want := []string{"example.com/a/orders.OrderFSM", "example.com/b/orders.CartFSM", "example.com/b/orders.OrderFSM"}
+	if !slices.Equal(paths, want) {
+		t.Fatal(paths)
+	}
+}
+
+func TestRegisterTwicePanics(t *testing.T) {
+	Register(Info{Name: "JobFSM", Package: "jobs", Path: "example.com/jobs"})
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering the same path and name twice should panic")
+		}
+	}()
+	Register(Info{Name: "JobFSM", Package: "jobs", Path: "example.com/jobs"})
+}
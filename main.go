@@ -1,15 +1,25 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
 	"io"
 	"maps"
 	"math"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
 	"slices"
 	"strings"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/BurntSushi/toml"
 )
@@ -19,18 +29,175 @@ type FSMDefinition struct {
 	Imports     []string
 	PackageName string
 	UseSLog     bool
-	Events      map[string]FSMEventDefinition
+	// ReturnEvent makes every event method return the Event constant it
+	// represents alongside the error, i.e. (Event, error) instead of error.
+	ReturnEvent bool
+	// EventStream publishes every successful transition on the channel
+	// returned by Events(). EventStreamPolicy picks what happens when the
+	// buffer is full: "block" (default) or "drop-oldest".
+	EventStream       bool
+	EventStreamBuffer int
+	EventStreamPolicy string
+	// Payloads generates an <Event>Payload struct per event holding its
+	// params, and Handle firing the event a payload belongs to.
+	Payloads bool
+	// ApplyAll generates ApplyAll for replaying batches of EventCalls.
+	// With ApplyAllRollback the state, visit counts and fired groups from
+	// before the batch are restored when any event in it fails.
+	ApplyAll         bool
+	ApplyAllRollback bool
+	// InitialState names the state a fresh machine starts in. It is
+	// optional since NewFSM always takes the start state explicitly.
+	InitialState string
+	// Acyclic rejects definitions whose transitions form a cycle, apart
+	// from self-loops.
+	Acyclic bool
+	// FinalStates are the states a run of the machine is expected to end in.
+	// Declaring any also generates ReachableFinalStates.
+	FinalStates []string
+	// DataDriven is set by the -data-driven flag.
+	DataDriven bool `toml:"-"`
+	// StringTable is set by the -string-table flag.
+	StringTable bool `toml:"-"`
+	// EmitTests is set by the -emit-tests flag.
+	EmitTests bool `toml:"-"`
+	// StringerCompatible is set by the -stringer-compatible flag.
+	StringerCompatible bool `toml:"-"`
+	// SQL is set by the -sql flag.
+	SQL bool `toml:"-"`
+	// JSON generates MarshalJSON/UnmarshalJSON storing the state by name,
+	// along with the visit counts when MaxVisits is used, the fired groups
+	// and whether it is paused.
+	JSON bool
+	// Pausable generates Pause/Resume; while paused every event method
+	// fails with ErrPaused and leaves the state alone.
+	Pausable bool
+	// UnspecifiedState reserves the zero State for a constant with this
+	// name, so an uninitialised FSM is detectably invalid.
+	UnspecifiedState string
+	// DoneCallback adds a trailing done func(State, error) param to every
+	// event method, called with the resulting state and error once the
+	// transition resolves. A nil done is ignored.
+	DoneCallback bool
+	// GenericContext is set by the -generic-context flag.
+	GenericContext bool `toml:"-"`
+	// Order lists every event name in the order their methods and Event
+	// constants are generated. Events are sorted by name when it is empty.
+	Order []string
+	// ExpectState generates ExpectState, returning a descriptive error
+	// when the FSM, or the region the wanted state belongs to, is not in
+	// the wanted state.
+	ExpectState bool
+	// Register adds the FSM to the fsmregistry package at init.
+	Register bool
+	// WouldChange generates WouldChange, reporting whether firing an event
+	// by name from the current state is valid and leaves the state.
+	WouldChange bool
+	// MapParams generates an <Event>Map method per event taking its params
+	// from a map[string]any keyed by param name.
+	MapParams bool
+	// StateInfo generates StateInfo, returning the current state's
+	// metadata from the States section.
+	StateInfo bool
+	// AllEvents generates AllEvents, describing every event's sources,
+	// destination, params and Doc.
+	AllEvents bool
+	// GoTo generates GoTo, firing the only event that leads from the
+	// current state to a state given by name.
+	GoTo bool
+	// PathEvents generates PathEvents, finding the shortest sequence of
+	// event names between two states.
+	PathEvents bool
+	// CanTransition adds a CanTransition field consulted before every
+	// transition, once every other check has passed, with the source,
+	// destination and event name. A nil func allows everything; returning
+	// false or an error rejects the event.
+	CanTransition bool
+	// Dispatcher generates Fire, calling an event method by its name
+	// matched case-insensitively with params passed as []any.
+	Dispatcher bool
+	// UnknownEvent picks what Fire does with an unknown event name:
+	// "error" (default) returns ErrUnknownEvent, "ignore" returns nil and
+	// "log" logs a slog warning and returns nil.
+	UnknownEvent string
+	// Fields are extra fields carried by every FSM instance, set through
+	// trailing NewFSM params.
+	Fields []FSMField
+	// Groups configures the event groups named by FSMEventDefinition.Group.
+	Groups map[string]FSMGroupDefinition
+	// Regions are parallel regions running next to the main machine, each
+	// keeping its current state in a <Region>State field of its own.
+	Regions map[string]FSMRegionDefinition
+	States  map[string]FSMStateDefinition
+	Events  map[string]FSMEventDefinition
+}
+
+type FSMField struct {
+	Name string
+	Type string
+	// Import is the package path Type needs, added to the generated imports.
+	Import string
+}
+
+type FSMRequirement struct {
+	// Provider is the key of the StateProvider in the FSM's Providers.
+	Provider string
+	State    string
+}
+
+type FSMGroupDefinition struct {
+	// ResetOn unlocks the group whenever the FSM enters this state.
+	ResetOn string
+}
+
+type FSMRegionDefinition struct {
+	// InitialState is the state NewFSM starts the region in, and the one
+	// ResetRegion<Region> returns it to.
+	InitialState string
+}
+
+type FSMStateDefinition struct {
+	// MaxVisits limits how many times the state may be entered through
+	// transitions. Once reached, entering it again fails with ErrMaxVisits,
+	// or goes to MaxVisitsFallback instead when that is set.
+	MaxVisits         uint
+	MaxVisitsFallback string
+	// Display, Doc and Tags are carried into the table behind StateInfo.
+	// Display defaults to the state's name.
+	Display string
+	Doc     string
+	Tags    []string
 }
 
 type FSMEventDefinition struct {
 	Source      []string
 	Destination string
 	Params      []FSMEventParams
+	// Requires lists states other machines must be in for the event to
+	// fire, checked through the FSM's Providers.
+	Requires []FSMRequirement
+	// Code is Go statements emitted verbatim at the end of the event method,
+	// after the state has changed and before it returns nil. It may use fsm
+	// and the params, and must not return.
+	Code string
+	// Doc describes the event for AllEvents.
+	Doc string
+	// Group makes the event mutually exclusive with the other events in
+	// the same group: once one fires, all of them fail with ErrGroupLocked
+	// until the group's ResetOn state is entered.
+	Group string
+	// Region names the entry in Regions whose state the event checks and
+	// moves, instead of State. Its states can't be used outside the region.
+	Region string
 }
 
 type FSMEventParams struct {
-	Name string
-	Type string
+	Name      string
+	Type      string
+	LogFields []string
+	// From names a field in Fields that supplies this param in the
+	// generated <Event>WithDefaults method.
+	From string
 }
 
 type _States []string
@@ -50,10 +217,147 @@ func _GetStates(def FSMDefinition) _States {
 	return states
 }
 
+// _GetStateRegions maps every state to the region its events belong to,
+// with "" for the main machine.
+func _GetStateRegions(def FSMDefinition) map[string]string {
+	regions := map[string]string{}
+	for _, event := range def.Events {
+		regions[event.Destination] = event.Region
+		for _, state := range event.Source {
+			regions[state] = event.Region
+		}
+	}
+	return regions
+}
+
+// _GetStateField is the FSM field holding the current state of region.
+func _GetStateField(region string) string {
+	if region == "" {
+		return "State"
+	}
+	return _GetMethodName(region) + "State"
+}
+
+func _GetInitialState(def FSMDefinition, region string) string {
+	if region == "" {
+		return def.InitialState
+	}
+	return def.Regions[region].InitialState
+}
+
 func _GetStateName(s string) string {
 	return "STATE_" + strings.ToUpper(s)
 }
 
+// With GenericContext the FSM and hook types take a type parameter T for
+// the Data carried by each instance.
+func _GetFSMType(def FSMDefinition) string {
+	if def.GenericContext {
+		return def.Name + "FSM[T]"
+	}
+	return def.Name + "FSM"
+}
+
+func _GetTypeParams(def FSMDefinition) (decl string, use string) {
+	if def.GenericContext {
+		return "[T any]", "[T]"
+	}
+	return "", ""
+}
+
+// Event names are exported as given with their first letter upper cased,
+// so a compact `approve = {...}` entry still yields an Approve method.
+func _GetMethodName(eventName string) string {
+	r, size := utf8.DecodeRuneInString(eventName)
+	return string(unicode.ToUpper(r)) + eventName[size:]
+}
+
+type _Events []string
+
+func _GetEvents(def FSMDefinition) _Events {
+	if len(def.Order) > 0 {
+		// Order entries without an event are reported by CheckDefinition.
+		return slices.DeleteFunc(slices.Clone(def.Order), func(eventName string) bool {
+			_, ok := def.Events[eventName]
+			return !ok
+		})
+	}
+
+	events := slices.AppendSeq([]string{}, maps.Keys(def.Events))
+	slices.Sort(events)
+	return events
+}
+
+func _GetEventName(s string) string {
+	return "EVENT_" + strings.ToUpper(s)
+}
+
+func _TracksVisits(def FSMDefinition) bool {
+	for _, state := range def.States {
+		if state.MaxVisits > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func _UsesGroups(def FSMDefinition) bool {
+	for _, event := range def.Events {
+		if event.Group != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func _UsesProviders(def FSMDefinition) bool {
+	for _, event := range def.Events {
+		if len(event.Requires) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func _HasDefaultedParams(event FSMEventDefinition) bool {
+	return slices.ContainsFunc(event.Params, func(param FSMEventParams) bool {
+		return param.From != ""
+	})
+}
+
+func _GetStdImports(def FSMDefinition) []string {
+	imports := []string{}
+	usesUnknownEvent := def.Dispatcher && (def.UnknownEvent == "" || def.UnknownEvent == "error")
+	if _TracksVisits(def) || def.Pausable || _UsesGroups(def) || _UsesProviders(def) || usesUnknownEvent || def.CanTransition {
+		imports = append(imports, "errors")
+	}
+	if def.JSON {
+		imports = append(imports, "encoding/json")
+	}
+	if def.StringerCompatible {
+		imports = append(imports, "strconv")
+	}
+	if def.SQL {
+		imports = append(imports, "database/sql/driver")
+	}
+	if def.Dispatcher {
+		imports = append(imports, "strings")
+	}
+	if def.PathEvents {
+		imports = append(imports, "sync")
+	}
+	if def.Register {
+		imports = append(imports, "reflect")
+	}
+	if def.ApplyAll && def.ApplyAllRollback && (_TracksVisits(def) || _UsesGroups(def)) {
+		imports = append(imports, "maps")
+	}
+	if def.Dispatcher && def.UnknownEvent == "log" && !def.UseSLog {
+		imports = append(imports, "log/slog")
+	}
+	return imports
+}
+
 func _GetNeededUintSize(count int) string {
 	stateEnumType := "uint8"
 
@@ -69,84 +373,1474 @@ func _GetNeededUintSize(count int) string {
 	return stateEnumType
 }
 
+var _BUILTIN_TYPES = []string{
+	"any", "bool", "byte", "complex64", "complex128", "error",
+	"float32", "float64", "int", "int8", "int16", "int32", "int64",
+	"rune", "string", "uint", "uint8", "uint16", "uint32", "uint64", "uintptr",
+}
+
+// Types are only known by name, so this rejects the ones that
+// definitely can't have fields rather than proving a struct.
+func _IsPossibleStructType(t string) bool {
+	t = strings.TrimPrefix(strings.TrimSpace(t), "*")
+	for _, prefix := range []string{"[", "map[", "chan ", "<-chan", "func(", "interface{"} {
+		if strings.HasPrefix(t, prefix) {
+			return false
+		}
+	}
+	return !slices.Contains(_BUILTIN_TYPES, t)
+}
+
+var _VARIABLE_PATTERN = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// ExpandVariables substitutes ${VAR} and ${VAR:-default} in the raw
+// definition text, preferring vars over the environment.
+func ExpandVariables(text string, vars map[string]string) (string, error) {
+	missing := []string{}
+
+	expanded := _VARIABLE_PATTERN.ReplaceAllStringFunc(text, func(token string) string {
+		match := _VARIABLE_PATTERN.FindStringSubmatch(token)
+		name, hasDefault, def := match[1], match[2] != "", match[3]
+
+		if value, ok := vars[name]; ok {
+			return value
+		}
+		if value, ok := os.LookupEnv(name); ok {
+			return value
+		}
+		if hasDefault {
+			return def
+		}
+		if !slices.Contains(missing, name) {
+			missing = append(missing, name)
+		}
+		return token
+	})
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("unset variables: %v", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
 func ParseTOML(r io.Reader) (FSMDefinition, error) {
 	fsm := FSMDefinition{}
 	_, err := toml.NewDecoder(r).Decode(&fsm)
 	return fsm, err
 }
 
-func BuildText(definition FSMDefinition) string {
-	builder := strings.Builder{}
+// Names of the fields and helper methods the generated FSM struct carries
+// for the enabled options, which event methods must not reuse.
+func _GetReservedMembers(def FSMDefinition) []string {
+	reserved := []string{"State", "_Hooks"}
+	if _TracksVisits(def) {
+		reserved = append(reserved, "Visits")
+	}
+	if def.GenericContext {
+		reserved = append(reserved, "Data")
+	}
+	if _UsesGroups(def) {
+		reserved = append(reserved, "_FiredGroups")
+	}
+	if _UsesProviders(def) {
+		reserved = append(reserved, "Providers")
+	}
+	if def.EventStream {
+		reserved = append(reserved, "_Events", "_EventsClosed", "Events", "StopEvents", "_Publish")
+	}
+	if def.JSON {
+		reserved = append(reserved, "MarshalJSON", "UnmarshalJSON")
+	}
+	if def.ApplyAll {
+		reserved = append(reserved, "ApplyAll", "_Apply")
+	}
+	if def.Payloads {
+		reserved = append(reserved, "Handle")
+	}
+	if def.Pausable {
+		reserved = append(reserved, "_Paused", "Pause", "Resume", "Paused")
+	}
+	if def.ExpectState {
+		reserved = append(reserved, "ExpectState")
+	}
+	if def.WouldChange {
+		reserved = append(reserved, "WouldChange")
+	}
+	if def.Dispatcher {
+		reserved = append(reserved, "Fire")
+	}
+	if def.CanTransition {
+		reserved = append(reserved, "CanTransition")
+	}
+	if def.GoTo {
+		reserved = append(reserved, "GoTo")
+	}
+	if len(def.FinalStates) > 0 {
+		reserved = append(reserved, "ReachableFinalStates")
+	}
+	if def.StateInfo {
+		reserved = append(reserved, "StateInfo")
+	}
+	for _, field := range def.Fields {
+		reserved = append(reserved, field.Name)
+	}
+	if len(def.Regions) > 0 {
+		reserved = append(reserved, "_CurrentState")
+	}
+	for _, name := range slices.Sorted(maps.Keys(def.Regions)) {
+		reserved = append(reserved, _GetStateField(name), "ResetRegion"+_GetMethodName(name))
+	}
+	for _, eventName := range _GetEvents(def) {
+		if def.MapParams {
+			reserved = append(reserved, _GetMethodName(eventName)+"Map")
+		}
+		if _HasDefaultedParams(def.Events[eventName]) {
+			reserved = append(reserved, _GetMethodName(eventName)+"WithDefaults")
+		}
+	}
+	return reserved
+}
+
+// _GetReservedParams maps the names an event method already uses, apart
+// from the Go builtins, to what a param of the same name would shadow.
+func _GetReservedParams(def FSMDefinition) map[string]string {
+	reserved := map[string]string{
+		"fsm":  "the receiver",
+		"hook": "the hook being called",
+		"fmt":  "the fmt package",
+	}
+	if def.UseSLog {
+		reserved["slog"] = "the slog package"
+	}
+	if def.DoneCallback {
+		reserved["done"] = "the done callback"
+		reserved["err"] = "the named error result"
+	}
+	if _TracksVisits(def) {
+		reserved["dest"] = "the MaxVisitsFallback destination"
+	}
+	if def.EventStream {
+		reserved["from"] = "the published source state"
+	}
+	if def.CanTransition {
+		reserved["allowed"] = "the CanTransition result"
+		reserved["vetoErr"] = "the CanTransition error"
+	}
+	return reserved
+}
+
+func _GetImports(def FSMDefinition) []string {
+	imports := slices.Clone(def.Imports)
+	for _, field := range def.Fields {
+		if field.Import != "" && !slices.Contains(imports, field.Import) {
+			imports = append(imports, field.Import)
+		}
+	}
+	return imports
+}
+
+func _GetDispatchKey(eventName string) string {
+	return strings.ToLower(eventName)
+}
+
+func _DescribeRegion(region string) string {
+	if region == "" {
+		return "the main machine"
+	}
+	return "region " + region
+}
+
+// _ValidateRegions checks every state belongs to exactly one region, so
+// each event only ever touches a single state field.
+func _ValidateRegions(definition FSMDefinition) []Finding {
+	findings := []Finding{}
+	if len(definition.Regions) > 0 {
+		for _, option := range []struct {
+			name    string
+			enabled bool
+		}{
+			{"JSON", definition.JSON},
+			{"WouldChange", definition.WouldChange},
+			{"GoTo", definition.GoTo},
+			{"StateInfo", definition.StateInfo},
+		} {
+			if option.enabled {
+				findings = append(findings, _Invalid(
+					"region-option", nil, nil,
+					"%v only knows the main machine's State and can't be used with Regions", option.name,
+				))
+			}
+		}
+	}
+
+	regions := map[string]string{}
+	for _, eventName := range _GetEvents(definition) {
+		event := definition.Events[eventName]
+		if _, ok := definition.Regions[event.Region]; event.Region != "" && !ok {
+			findings = append(findings, _Invalid(
+				"undeclared-region", nil, []string{eventName},
+				"event %v: Region %v is not declared in Regions", eventName, event.Region,
+			))
+			continue
+		}
+		for _, state := range append(slices.Clone(event.Source), event.Destination) {
+			if region, ok := regions[state]; ok && region != event.Region {
+				findings = append(findings, _Invalid(
+					"region-state", []string{state}, []string{eventName},
+					"event %v uses state %v of %v in %v",
+					eventName, state, _DescribeRegion(region), _DescribeRegion(event.Region),
+				))
+				continue
+			}
+			regions[state] = event.Region
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(definition.Regions)) {
+		initialState := definition.Regions[name].InitialState
+		switch region, ok := regions[initialState]; {
+		case !token.IsIdentifier(name):
+			findings = append(findings, _Invalid("region-name", nil, nil, "region name %q is not a valid Go identifier", name))
+		case initialState == "":
+			findings = append(findings, _Invalid("region-initial-state", nil, nil, "Regions.%v needs an InitialState", name))
+		case !ok || region != name:
+			findings = append(findings, _Invalid(
+				"region-initial-state", []string{initialState}, nil,
+				"Regions.%v InitialState %v is not used by any of its events", name, initialState,
+			))
+		}
+	}
+
+	if region := regions[definition.InitialState]; region != "" {
+		findings = append(findings, _Invalid(
+			"region-initial-state", []string{definition.InitialState}, nil,
+			"InitialState %v belongs to region %v", definition.InitialState, region,
+		))
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(definition.States)) {
+		fallback := definition.States[name].MaxVisitsFallback
+		if fallback != "" && regions[fallback] != regions[name] {
+			findings = append(findings, _Invalid(
+				"max-visits-fallback", []string{name, fallback}, nil,
+				"States.%v MaxVisitsFallback %v is in %v, not %v",
+				name, fallback, _DescribeRegion(regions[fallback]), _DescribeRegion(regions[name]),
+			))
+		}
+	}
+	return findings
+}
+
+// _Invalid is an error Finding of CheckDefinition.
+func _Invalid(category string, states []string, events []string, format string, args ...any) Finding {
+	return Finding{
+		Severity: "error",
+		Category: category,
+		Message:  fmt.Sprintf(format, args...),
+		States:   states,
+		Events:   events,
+	}
+}
+
+// CheckDefinition lists everything that keeps the definition from being
+// generated, so one run of -report shows all of it.
+func CheckDefinition(definition FSMDefinition) []Finding {
+	findings := []Finding{}
+
+	if !token.IsIdentifier(definition.PackageName) {
+		findings = append(findings, _Invalid(
+			"package-name", nil, nil,
+			"PackageName %q is not a valid Go package name", definition.PackageName,
+		))
+	}
+
+	switch definition.UnknownEvent {
+	case "", "error", "ignore", "log":
+	default:
+		findings = append(findings, _Invalid(
+			"unknown-event-policy", nil, nil,
+			"unknown UnknownEvent %v, expected error, ignore or log", definition.UnknownEvent,
+		))
+	}
+
+	if definition.Dispatcher {
+		keys := map[string]string{}
+		for _, eventName := range _GetEvents(definition) {
+			key := _GetDispatchKey(eventName)
+			if other, ok := keys[key]; ok {
+				findings = append(findings, _Invalid(
+					"name-collision", nil, []string{other, eventName},
+					"events %v and %v both dispatch as %q in Fire", other, eventName, key,
+				))
+				continue
+			}
+			keys[key] = eventName
+		}
+	}
+
+	withoutFields := definition
+	withoutFields.Fields = nil
+	members := _GetReservedMembers(withoutFields)
+	fieldNames := map[string]bool{}
+	for _, field := range definition.Fields {
+		switch {
+		case !token.IsIdentifier(field.Name):
+			findings = append(findings, _Invalid("field-name", nil, nil, "field name %q is not a valid Go identifier", field.Name))
+			continue
+		case field.Name == "startState" || field.Name == "data":
+			findings = append(findings, _Invalid("field-name", nil, nil, "field name %v collides with a NewFSM param", field.Name))
+			continue
+		case slices.Contains(members, field.Name):
+			findings = append(findings, _Invalid(
+				"name-collision", nil, nil,
+				"field name %v collides with a generated member of %vFSM", field.Name, definition.Name,
+			))
+			continue
+		case fieldNames[field.Name]:
+			findings = append(findings, _Invalid("field-name", nil, nil, "field %v is declared more than once", field.Name))
+			continue
+		}
+		fieldNames[field.Name] = true
+		if _, err := parser.ParseExpr(field.Type); err != nil {
+			findings = append(findings, _Invalid("field-type", nil, nil, "field %v has invalid type %q: %v", field.Name, field.Type, err))
+		}
+	}
+
+	if definition.EmitTests && definition.GenericContext {
+		findings = append(findings, _Invalid("unsupported-options", nil, nil, "-emit-tests does not support -generic-context"))
+	}
+
+	if len(definition.Order) > 0 {
+		seen := map[string]bool{}
+		for _, eventName := range definition.Order {
+			if _, ok := definition.Events[eventName]; !ok {
+				findings = append(findings, _Invalid("order", nil, []string{eventName}, "Order lists unknown event %v", eventName))
+				continue
+			}
+			if seen[eventName] {
+				findings = append(findings, _Invalid("order", nil, []string{eventName}, "Order lists event %v more than once", eventName))
+			}
+			seen[eventName] = true
+		}
+		for _, eventName := range slices.Sorted(maps.Keys(definition.Events)) {
+			if !seen[eventName] {
+				findings = append(findings, _Invalid("order", nil, []string{eventName}, "Order is missing event %v", eventName))
+			}
+		}
+	}
+
+	reserved := _GetReservedMembers(definition)
+	methods := map[string]string{}
+	constants := map[string]string{}
+	for _, eventName := range _GetEvents(definition) {
+		reserved = append(reserved, "Set"+_GetMethodName(eventName)+"Hook")
+	}
+	for _, eventName := range _GetEvents(definition) {
+		methodName := _GetMethodName(eventName)
+		if slices.Contains(reserved, methodName) {
+			findings = append(findings, _Invalid(
+				"name-collision", nil, []string{eventName},
+				"event %v collides with a generated member of %vFSM, consider renaming it to %vEvent",
+				eventName, definition.Name, eventName,
+			))
+		}
+		if other, ok := methods[methodName]; ok {
+			findings = append(findings, _Invalid(
+				"name-collision", nil, []string{other, eventName},
+				"events %v and %v both generate the method %v", other, eventName, methodName,
+			))
+		}
+		methods[methodName] = eventName
+
+		constName := _GetEventName(eventName)
+		if other, ok := constants[constName]; ok {
+			findings = append(findings, _Invalid(
+				"name-collision", nil, []string{other, eventName},
+				"events %v and %v both generate the constant %v", other, eventName, constName,
+			))
+		}
+		constants[constName] = eventName
+	}
+
+	states := _GetStates(definition)
+	stateConstants := map[string]string{}
+	for _, state := range states {
+		constName := _GetStateName(state)
+		if other, ok := stateConstants[constName]; ok {
+			findings = append(findings, _Invalid(
+				"name-collision", []string{other, state}, nil,
+				"states %v and %v both generate the constant %v", other, state, constName,
+			))
+			continue
+		}
+		stateConstants[constName] = state
+	}
+
+	if unspecified := definition.UnspecifiedState; unspecified != "" {
+		constName := _GetStateName(unspecified)
+		if !token.IsIdentifier(unspecified) {
+			findings = append(findings, _Invalid(
+				"unspecified-state", nil, nil,
+				"UnspecifiedState %q is not a valid Go identifier", unspecified,
+			))
+		} else if slices.Contains(states, unspecified) {
+			findings = append(findings, _Invalid(
+				"unspecified-state", []string{unspecified}, nil,
+				"UnspecifiedState %v is also used as a real state", unspecified,
+			))
+		} else if other, ok := stateConstants[constName]; ok {
+			findings = append(findings, _Invalid(
+				"name-collision", []string{unspecified, other}, nil,
+				"UnspecifiedState %v and state %v both generate the constant %v", unspecified, other, constName,
+			))
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(definition.States)) {
+		state := definition.States[name]
+		if !slices.Contains(states, name) {
+			findings = append(findings, _Invalid("undeclared-state", []string{name}, nil, "States.%v is not used by any event", name))
+			continue
+		}
+		if state.MaxVisitsFallback == "" {
+			continue
+		}
+		if state.MaxVisits == 0 {
+			findings = append(findings, _Invalid(
+				"max-visits-fallback", []string{name}, nil,
+				"States.%v has MaxVisitsFallback without MaxVisits", name,
+			))
+		}
+		if !slices.Contains(states, state.MaxVisitsFallback) {
+			findings = append(findings, _Invalid(
+				"max-visits-fallback", []string{name, state.MaxVisitsFallback}, nil,
+				"States.%v MaxVisitsFallback %v is not used by any event", name, state.MaxVisitsFallback,
+			))
+		}
+	}
+
+	if definition.InitialState != "" && !slices.Contains(states, definition.InitialState) {
+		findings = append(findings, _Invalid(
+			"undeclared-initial-state", []string{definition.InitialState}, nil,
+			"InitialState %v is not used by any event", definition.InitialState,
+		))
+	}
+
+	findings = append(findings, _ValidateRegions(definition)...)
+
+	for _, name := range slices.Sorted(maps.Keys(definition.Groups)) {
+		resetOn := definition.Groups[name].ResetOn
+		if resetOn != "" && !slices.Contains(states, resetOn) {
+			findings = append(findings, _Invalid(
+				"group", []string{resetOn}, nil,
+				"Groups.%v ResetOn %v is not used by any event", name, resetOn,
+			))
+		}
+	}
+
+	if definition.Acyclic {
+		if cycle := FindCycle(definition); cycle != nil {
+			findings = append(findings, _Invalid(
+				"cycle", cycle, nil,
+				"definition is marked Acyclic but has the cycle %v -> %v",
+				strings.Join(cycle, " -> "), cycle[0],
+			))
+		}
+	}
+
+	for _, state := range definition.FinalStates {
+		if !slices.Contains(states, state) {
+			findings = append(findings, _Invalid(
+				"undeclared-final-state", []string{state}, nil,
+				"FinalStates lists %v which is not used by any event", state,
+			))
+		}
+	}
+
+	switch definition.EventStreamPolicy {
+	case "", "block", "drop-oldest":
+	default:
+		findings = append(findings, _Invalid(
+			"event-stream-policy", nil, nil,
+			"unknown EventStreamPolicy %v, expected block or drop-oldest", definition.EventStreamPolicy,
+		))
+	}
+
+	if definition.EventStreamBuffer < 0 {
+		findings = append(findings, _Invalid(
+			"event-stream-buffer", nil, nil,
+			"EventStreamBuffer must not be negative, got %v", definition.EventStreamBuffer,
+		))
+	}
+
+	reservedParams := _GetReservedParams(definition)
+	for _, eventName := range slices.Sorted(maps.Keys(definition.Events)) {
+		event := definition.Events[eventName]
+		if event.Code != "" {
+			src := "package p\nfunc _() {\n" + event.Code + "\n}\n"
+			file, err := parser.ParseFile(token.NewFileSet(), eventName, src, 0)
+			if err != nil {
+				findings = append(findings, _Invalid(
+					"event-code", nil, []string{eventName},
+					"event %v: Code does not parse as Go statements: %v", eventName, err,
+				))
+			} else if len(file.Decls) != 1 {
+				// Code closing the wrapper's brace would parse as extra
+				// declarations instead of landing inside the event method.
+				findings = append(findings, _Invalid(
+					"event-code", nil, []string{eventName},
+					"event %v: Code must only contain statements, not declarations", eventName,
+				))
+			}
+		}
+		if _, ok := definition.Groups[event.Group]; event.Group != "" && !ok {
+			findings = append(findings, _Invalid(
+				"group", nil, []string{eventName},
+				"event %v: Group %v is not declared in Groups", eventName, event.Group,
+			))
+		}
+		for _, requirement := range event.Requires {
+			if requirement.Provider == "" || requirement.State == "" {
+				findings = append(findings, _Invalid(
+					"requires", nil, []string{eventName},
+					"event %v: Requires entries need both Provider and State", eventName,
+				))
+			}
+		}
+		for _, param := range event.Params {
+			findings = append(findings, _CheckParam(definition, eventName, param, reservedParams)...)
+		}
+
+		if definition.Payloads {
+			if payload := _GetMethodName(eventName) + "Payload"; payload == "EventPayload" {
+				findings = append(findings, _Invalid(
+					"name-collision", nil, []string{eventName},
+					"event %v: payload struct %v collides with the EventPayload interface, rename the event", eventName, payload,
+				))
+			}
+			fields := map[string]string{}
+			for _, param := range event.Params {
+				field := _GetMethodName(param.Name)
+				if other, ok := fields[field]; ok {
+					findings = append(findings, _Invalid(
+						"name-collision", nil, []string{eventName},
+						"event %v: params %v and %v both become the payload field %v", eventName, other, param.Name, field,
+					))
+				}
+				fields[field] = param.Name
+			}
+		}
+	}
+	return findings
+}
+
+// _CheckParam reports the first problem with one of eventName's params.
+func _CheckParam(definition FSMDefinition, eventName string, param FSMEventParams, reservedParams map[string]string) []Finding {
+	events := []string{eventName}
+	if !token.IsIdentifier(param.Name) {
+		return []Finding{_Invalid(
+			"param-name", nil, events,
+			"event %v: param name %q is not a valid Go identifier", eventName, param.Name,
+		)}
+	}
+	if shadowed, ok := reservedParams[param.Name]; ok {
+		return []Finding{_Invalid(
+			"param-shadowing", nil, events,
+			"event %v: param %v would shadow %v, rename it", eventName, param.Name, shadowed,
+		)}
+	}
+	if types.Universe.Lookup(param.Name) != nil {
+		return []Finding{_Invalid(
+			"param-shadowing", nil, events,
+			"event %v: param %v would shadow the Go builtin %v, rename it", eventName, param.Name, param.Name,
+		)}
+	}
+
+	if param.From != "" {
+		i := slices.IndexFunc(definition.Fields, func(field FSMField) bool {
+			return field.Name == param.From
+		})
+		if i < 0 {
+			return []Finding{_Invalid(
+				"param-from", nil, events,
+				"event %v: param %v is From undeclared field %v", eventName, param.Name, param.From,
+			)}
+		}
+		if definition.Fields[i].Type != param.Type {
+			return []Finding{_Invalid(
+				"param-from", nil, events,
+				"event %v: param %v has type %v but field %v is %v",
+				eventName, param.Name, param.Type, param.From, definition.Fields[i].Type,
+			)}
+		}
+	}
+
+	if len(param.LogFields) > 0 && !_IsPossibleStructType(param.Type) {
+		return []Finding{_Invalid(
+			"param-log-fields", nil, events,
+			"event %v: param %v has LogFields but type %v is not a struct",
+			eventName, param.Name, param.Type,
+		)}
+	}
+	return nil
+}
+
+// ValidateDefinition returns the first problem CheckDefinition finds.
+func ValidateDefinition(definition FSMDefinition) error {
+	if findings := CheckDefinition(definition); len(findings) > 0 {
+		return errors.New(findings[0].Message)
+	}
+	return nil
+}
+
+func _GetTransitionSignature(event FSMEventDefinition) string {
+	sources := slices.Clone(event.Source)
+	slices.Sort(sources)
+
+	params := []string{}
+	for _, param := range event.Params {
+		params = append(params, param.Name+" "+param.Type)
+	}
+
+	return fmt.Sprintf(
+		"%v -> %v (%v)",
+		strings.Join(sources, ","),
+		event.Destination,
+		strings.Join(params, ","),
+	)
+}
+
+// Events sharing sources, destination and params are usually a copy-paste
+// mistake, so each group of them is reported as a single warning.
+func CheckDuplicateTransitions(definition FSMDefinition) []Finding {
+	groups := map[string][]string{}
+	for _, eventName := range _GetEvents(definition) {
+		signature := _GetTransitionSignature(definition.Events[eventName])
+		groups[signature] = append(groups[signature], eventName)
+	}
+
+	warnings := []Finding{}
+	for _, signature := range slices.Sorted(maps.Keys(groups)) {
+		if len(groups[signature]) < 2 {
+			continue
+		}
+		warnings = append(warnings, Finding{
+			Severity: "warning",
+			Category: "duplicate-transition",
+			Message: fmt.Sprintf(
+				"events %v share the transition %v",
+				strings.Join(groups[signature], ", "),
+				signature,
+			),
+			Events: groups[signature],
+		})
+	}
+	return warnings
+}
+
+func BuildText(definition FSMDefinition) string {
+	builder := strings.Builder{}
+
+	states := _GetStates(definition)
+	events := _GetEvents(definition)
+
+	GenerateHeader(&builder, definition)
+	GenerateStateDefinition(&builder, definition, states)
+	GenerateEventDefinition(&builder, definition, events)
+	GenerateInitalizer(&builder, definition)
+	GenerateFSMDefinition(&builder, definition)
+	GenerateLookup(&builder, definition, states)
+
+	if _TracksVisits(definition) {
+		builder.WriteString(MAX_VISITS_DEF)
+	}
+
+	if _UsesGroups(definition) {
+		builder.WriteString(GROUP_LOCKED_DEF)
+	}
+
+	if definition.CanTransition {
+		builder.WriteString(TRANSITION_VETO_DEF)
+	}
+
+	if _UsesProviders(definition) {
+		builder.WriteString(STATE_PROVIDER_DEF)
+	}
+
+	if definition.EventStream {
+		GenerateEventStream(&builder, definition)
+	}
+
+	if definition.Register {
+		GenerateRegistration(&builder, definition, states, events)
+	}
+
+	if definition.WouldChange {
+		GenerateWouldChange(&builder, definition, events)
+	}
+
+	if definition.Dispatcher {
+		GenerateDispatcher(&builder, definition, events)
+	}
+
+	if definition.PathEvents {
+		GeneratePathEvents(&builder, definition, states, events)
+	}
+
+	if len(definition.FinalStates) > 0 {
+		GenerateReachableFinalStates(&builder, definition, states)
+	}
+
+	if definition.StateInfo {
+		GenerateStateInfo(&builder, definition, states)
+	}
+
+	if definition.AllEvents {
+		GenerateAllEvents(&builder, definition)
+	}
+
+	if definition.ExpectState {
+		fmt.Fprintf(&builder, EXPECT_STATE_DEF, _GetFSMType(definition), _GetCurrentState(definition, "fsm", "want"))
+	}
+
+	if definition.Pausable {
+		fsmType := _GetFSMType(definition)
+		fmt.Fprintf(&builder, PAUSE_DEF, fsmType, fsmType, fsmType)
+	}
+
+	if len(definition.Regions) > 0 {
+		GenerateRegionResets(&builder, definition)
+		GenerateCurrentState(&builder, definition, states)
+	}
+
+	if definition.DataDriven {
+		GenerateDataDriven(&builder, definition, states, events)
+	}
+
+	if definition.JSON || definition.SQL || definition.GoTo {
+		builder.WriteString(STATE_FROM_STRING_DEF)
+	}
+
+	if definition.GoTo {
+		GenerateGoTo(&builder, definition, states, events)
+	}
+
+	if definition.SQL {
+		scanNull := SQL_SCAN_NULL_ERROR
+		if definition.UnspecifiedState != "" {
+			scanNull = SQL_SCAN_NULL_UNSPECIFIED
+		}
+		fmt.Fprintf(&builder, SQL_DEF, scanNull)
+	}
+
+	if definition.StringTable {
+		GenerateStringTable(&builder, definition, states, events)
+	}
+
+	if definition.JSON {
+		GenerateJSON(&builder, definition)
+	}
+
+	if definition.ApplyAll {
+		GenerateApplyAll(&builder, definition, events)
+	}
+
+	if definition.Payloads {
+		GeneratePayloads(&builder, definition, events)
+	}
+
+	for _, eventName := range events {
+		GenerateFSMEvent(&builder, definition, eventName, definition.Events[eventName])
+	}
+	return builder.String()
+}
+
+// BuildTestText generates the _test.go support file emitted alongside the
+// FSM by -emit-tests.
+func BuildTestText(definition FSMDefinition) string {
+	builder := strings.Builder{}
+	events := _GetEvents(definition)
+
+	fmt.Fprintf(&builder, TEST_HEADER, definition.PackageName)
+	for _, imprt := range _GetImports(definition) {
+		if _UsedByTypes(definition, imprt) {
+			fmt.Fprintf(&builder, "\"%v\"\n", imprt)
+		}
+	}
+	builder.WriteRune(')')
+
+	zeroFields := ""
+	for _, field := range definition.Fields {
+		zeroFields += fmt.Sprintf(", *new(%v)", field.Type)
+	}
+
+	hooks := strings.Builder{}
+	cases := strings.Builder{}
+	for _, eventName := range events {
+		types := []string{}
+		for _, param := range definition.Events[eventName].Params {
+			types = append(types, param.Type)
+		}
+		fmt.Fprintf(&hooks, "fsm.Set%vHook(func(%v) {})\n", _GetMethodName(eventName), strings.Join(types, ","))
+
+		fmt.Fprintf(&cases, "case %q:\n", eventName)
+		cases.WriteString(_GetDispatchCall(definition, eventName, "s.FSM", "params"))
+	}
+
+	stateNames := []string{}
+	for _, state := range _GetStates(definition) {
+		stateNames = append(stateNames, _GetStateName(state))
+	}
+	fmt.Fprintf(&builder, LOOKUP_TEST_DEF, strings.Join(stateNames, ", "))
+
+	fmt.Fprintf(
+		&builder,
+		SCENARIO_DEF,
+		_GetFSMType(definition),
+		zeroFields,
+		hooks.String(),
+		_GetCurrentState(definition, "s.FSM", "want"),
+		cases.String(),
+	)
+	return builder.String()
+}
+
+// Imports are only known by path, so this treats one as used when a param
+// or field type is qualified by the path's last element.
+func _UsedByTypes(definition FSMDefinition, imprt string) bool {
+	qualifier := imprt[strings.LastIndex(imprt, "/")+1:] + "."
+	for _, field := range definition.Fields {
+		if strings.Contains(field.Type, qualifier) {
+			return true
+		}
+	}
+	for _, event := range definition.Events {
+		for _, param := range event.Params {
+			if strings.Contains(param.Type, qualifier) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func GenerateHeader(builder *strings.Builder, definition FSMDefinition) {
+	fmt.Fprintf(
+		builder,
+		HEADER,
+		definition.PackageName,
+	)
+
+	if definition.UseSLog {
+		builder.WriteString("\"log/slog\"\n")
+	}
+
+	for _, imprt := range _GetStdImports(definition) {
+		fmt.Fprintf(builder, "\"%v\"\n", imprt)
+	}
+
+	if definition.Register {
+		fmt.Fprintf(builder, "\"%v\"\n", REGISTRY_IMPORT)
+	}
+
+	for _, imprt := range _GetImports(definition) {
+		fmt.Fprintf(builder, "\"%v\"\n", imprt)
+	}
+
+	builder.WriteRune(')')
+}
+
+func GenerateStateDefinition(builder *strings.Builder, definition FSMDefinition, states _States) {
+
+	if definition.UnspecifiedState != "" {
+		states = append(_States{definition.UnspecifiedState}, states...)
+	}
+
+	stateEnumType := _GetNeededUintSize(len(states))
+
+	state0 := states[0]
+
+	fmt.Fprintf(
+		builder,
+		STATES_DEF,
+		stateEnumType,
+		_GetStateName(state0),
+	)
+
+	for i, state := range states {
+		if i == 0 {
+			continue
+		}
+		builder.WriteString(_GetStateName(state))
+		builder.WriteRune('\n')
+	}
+
+	builder.WriteString("\n)")
+
+	if definition.UnspecifiedState != "" {
+		builder.WriteString(STATE_IS_VALID_DEF)
+	}
+
+	if definition.StringerCompatible {
+		GenerateStringer(builder, states)
+	}
+}
+
+// GenerateStringer writes the same String method the stringer tool would
+// for the State constants, so a //go:generate stringer line can be dropped.
+func GenerateStringer(builder *strings.Builder, states _States) {
+	checks := strings.Builder{}
+	names := strings.Builder{}
+	indices := []string{"0"}
+	for i, state := range states {
+		fmt.Fprintf(&checks, "_ = x[%v-%v]\n", _GetStateName(state), i)
+		names.WriteString(_GetStateName(state))
+		indices = append(indices, fmt.Sprint(names.Len()))
+	}
+
+	fmt.Fprintf(
+		builder,
+		STRINGER_DEF,
+		strings.TrimSuffix(checks.String(), "\n"),
+		names.String(),
+		_GetNeededUintSize(names.Len()),
+		strings.Join(indices, ", "),
+	)
+}
+
+func GenerateEventDefinition(builder *strings.Builder, definition FSMDefinition, events _Events) {
+	fmt.Fprintf(
+		builder,
+		EVENTS_DEF,
+		_GetNeededUintSize(len(events)),
+		_GetEventName(events[0]),
+	)
+
+	for _, event := range events[1:] {
+		builder.WriteString(_GetEventName(event))
+		builder.WriteRune('\n')
+	}
+
+	builder.WriteString("\n)")
+
+	builder.WriteString(EVENT_INDICES_DEF)
+	for _, event := range events {
+		builder.WriteString(_GetEventName(event))
+		builder.WriteString(",\n")
+	}
+	builder.WriteRune('}')
+	builder.WriteString(EVENT_INDICES_CHECK)
+
+	names := strings.Builder{}
+	for _, event := range events {
+		fmt.Fprintf(&names, "%v: %q,\n", _GetEventName(event), event)
+	}
+	fmt.Fprintf(builder, EVENT_NAMES_DEF, names.String())
+}
+
+func GenerateFSMDefinition(builder *strings.Builder, definition FSMDefinition) {
+	fields := strings.Builder{}
+
+	for _, name := range slices.Sorted(maps.Keys(definition.Regions)) {
+		fmt.Fprintf(&fields, "%v State\n", _GetStateField(name))
+	}
+
+	if _TracksVisits(definition) {
+		fields.WriteString("Visits map[State]uint\n")
+	}
+
+	for _, field := range definition.Fields {
+		fmt.Fprintf(&fields, "%v %v\n", field.Name, field.Type)
+	}
+
+	if definition.GenericContext {
+		fields.WriteString("Data T\n")
+	}
+
+	if _UsesGroups(definition) {
+		fields.WriteString("_FiredGroups map[string]bool\n")
+	}
+
+	if _UsesProviders(definition) {
+		fields.WriteString("Providers map[string]StateProvider\n")
+	}
+
+	if definition.Pausable {
+		fields.WriteString("_Paused bool\n")
+	}
+
+	if definition.CanTransition {
+		fields.WriteString("CanTransition func(from, to State, event string) (bool, error)\n")
+	}
+
+	if definition.EventStream {
+		fields.WriteString("_Events chan Transition\n")
+		fields.WriteString("_EventsClosed bool\n")
+	}
+
+	typeParams, _ := _GetTypeParams(definition)
+
+	fmt.Fprintf(
+		builder,
+		FSM_DEF,
+		definition.Name,
+		typeParams,
+		fields.String(),
+	)
+}
+
+func GenerateEventStream(builder *strings.Builder, definition FSMDefinition) {
+	publish := EVENT_STREAM_BLOCK
+	if definition.EventStreamPolicy == "drop-oldest" {
+		publish = EVENT_STREAM_DROP_OLDEST
+	}
+
+	fmt.Fprintf(
+		builder,
+		EVENT_STREAM_DEF,
+		_GetFSMType(definition),
+		_GetFSMType(definition),
+		_GetFSMType(definition),
+		publish,
+	)
+}
+
+func GeneratePathEvents(builder *strings.Builder, definition FSMDefinition, states _States, events _Events) {
+	edges := strings.Builder{}
+	for _, state := range states {
+		fmt.Fprintf(&edges, "%v: {\n", _GetStateName(state))
+		for _, eventName := range events {
+			event := definition.Events[eventName]
+			if slices.Contains(event.Source, state) {
+				fmt.Fprintf(&edges, "{%q, %v},\n", eventName, _GetStateName(event.Destination))
+			}
+		}
+		edges.WriteString("},\n")
+	}
+
+	fmt.Fprintf(builder, PATH_EVENTS_DEF, edges.String())
+}
+
+func GenerateReachableFinalStates(builder *strings.Builder, definition FSMDefinition, states _States) {
+	adjacency := _GetAdjacency(definition)
+	finals := slices.Clone(definition.FinalStates)
+	slices.Sort(finals)
+
+	table := strings.Builder{}
+	for _, state := range states {
+		reachable := adjacency.Reachable(state)
+		names := []string{}
+		for _, final := range finals {
+			if reachable[final] {
+				names = append(names, _GetStateName(final))
+			}
+		}
+		fmt.Fprintf(&table, "%v: {%v},\n", _GetStateName(state), strings.Join(names, ", "))
+	}
+
+	current := []string{"fsm.State"}
+	for _, name := range slices.Sorted(maps.Keys(definition.Regions)) {
+		current = append(current, "fsm."+_GetStateField(name))
+	}
+
+	fmt.Fprintf(builder, REACHABLE_FINAL_STATES_DEF, table.String(), _GetFSMType(definition), strings.Join(current, ", "))
+}
+
+func GenerateStateInfo(builder *strings.Builder, definition FSMDefinition, states _States) {
+	table := strings.Builder{}
+	for _, state := range states {
+		meta := definition.States[state]
+		display := meta.Display
+		if display == "" {
+			display = state
+		}
+
+		tags := "nil"
+		if len(meta.Tags) > 0 {
+			quoted := []string{}
+			for _, tag := range meta.Tags {
+				quoted = append(quoted, fmt.Sprintf("%q", tag))
+			}
+			tags = "[]string{" + strings.Join(quoted, ", ") + "}"
+		}
+
+		fmt.Fprintf(
+			&table,
+			"%v: {Name: %q, Display: %q, Doc: %q, Tags: %v, Final: %v},\n",
+			_GetStateName(state), state, display, meta.Doc, tags,
+			slices.Contains(definition.FinalStates, state),
+		)
+	}
+
+	fmt.Fprintf(builder, STATE_INFO_DEF, table.String(), _GetFSMType(definition))
+}
+
+func GenerateGoTo(builder *strings.Builder, definition FSMDefinition, states _States, events _Events) {
+	cases := strings.Builder{}
+	for _, state := range states {
+		into := map[string][]string{}
+		for _, eventName := range events {
+			event := definition.Events[eventName]
+			if slices.Contains(event.Source, state) {
+				into[event.Destination] = append(into[event.Destination], eventName)
+			}
+		}
+		if len(into) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(&cases, "case %v:\nswitch target {\n", _GetStateName(state))
+		for _, dest := range slices.Sorted(maps.Keys(into)) {
+			fmt.Fprintf(&cases, "case %v:\n", _GetStateName(dest))
+
+			candidates := into[dest]
+			event := definition.Events[candidates[0]]
+			switch {
+			case len(candidates) > 1:
+				fmt.Fprintf(
+					&cases,
+					"return fmt.Errorf(\"ambiguous: events %v all lead from %v to %v\")\n",
+					strings.Join(candidates, ", "), state, dest,
+				)
+			case len(event.Params) > 0:
+				fmt.Fprintf(
+					&cases,
+					"return fmt.Errorf(\"event %v leads from %v to %v but takes params\")\n",
+					candidates[0], state, dest,
+				)
+			default:
+				args := ""
+				if definition.DoneCallback {
+					args = "nil"
+				}
+				if definition.ReturnEvent {
+					fmt.Fprintf(&cases, "_, err := fsm.%v(%v)\nreturn err\n", _GetMethodName(candidates[0]), args)
+				} else {
+					fmt.Fprintf(&cases, "return fsm.%v(%v)\n", _GetMethodName(candidates[0]), args)
+				}
+			}
+		}
+		cases.WriteString("}\n")
+	}
+
+	fmt.Fprintf(builder, GO_TO_DEF, _GetFSMType(definition), cases.String())
+}
+
+func GenerateAllEvents(builder *strings.Builder, definition FSMDefinition) {
+	infos := strings.Builder{}
+	for _, eventName := range slices.Sorted(maps.Keys(definition.Events)) {
+		event := definition.Events[eventName]
+
+		sources := []string{}
+		for _, src := range event.Source {
+			sources = append(sources, fmt.Sprintf("%q", src))
+		}
+
+		params := []string{}
+		for _, param := range event.Params {
+			params = append(params, fmt.Sprintf("{Name: %q, Type: %q}", param.Name, param.Type))
+		}
+
+		fmt.Fprintf(
+			&infos,
+			"{Name: %q, Sources: []string{%v}, Destination: %q, Params: []EventParam{%v}, Doc: %q},\n",
+			eventName, strings.Join(sources, ", "), event.Destination, strings.Join(params, ", "), event.Doc,
+		)
+	}
+
+	fmt.Fprintf(builder, ALL_EVENTS_DEF, infos.String())
+}
+
+func GenerateDispatcher(builder *strings.Builder, definition FSMDefinition, events _Events) {
+	cases := strings.Builder{}
+	for _, eventName := range events {
+		fmt.Fprintf(&cases, "case %q:\n", _GetDispatchKey(eventName))
+		cases.WriteString(_GetDispatchCall(definition, eventName, "fsm", "params"))
+	}
+
+	unknown := UNKNOWN_EVENT_ERROR
+	switch definition.UnknownEvent {
+	case "ignore":
+		unknown = UNKNOWN_EVENT_IGNORE
+	case "log":
+		unknown = UNKNOWN_EVENT_LOG
+	}
+
+	if unknown == UNKNOWN_EVENT_ERROR {
+		builder.WriteString(UNKNOWN_EVENT_DEF)
+	}
+
+	fmt.Fprintf(builder, DISPATCHER_DEF, _GetFSMType(definition), cases.String(), unknown)
+}
+
+func GenerateWouldChange(builder *strings.Builder, definition FSMDefinition, events _Events) {
+	cases := strings.Builder{}
+	for _, eventName := range events {
+		event := definition.Events[eventName]
+
+		validSrcs := []string{}
+		for _, src := range event.Source {
+			validSrcs = append(validSrcs, _GetStateName(src))
+		}
+
+		fmt.Fprintf(
+			&cases,
+			"case %q:\nswitch fsm.State {\ncase %v:\nreturn fsm.State != %v\n}\n",
+			eventName,
+			strings.Join(validSrcs, ","),
+			_GetStateName(event.Destination),
+		)
+	}
+
+	fmt.Fprintf(builder, WOULD_CHANGE_DEF, _GetFSMType(definition), cases.String())
+}
+
+func GenerateRegistration(builder *strings.Builder, definition FSMDefinition, states _States, events _Events) {
+	quote := func(names []string) string {
+		quoted := []string{}
+		for _, name := range names {
+			quoted = append(quoted, fmt.Sprintf("%q", name))
+		}
+		return strings.Join(quoted, ", ")
+	}
+
+	fmt.Fprintf(
+		builder,
+		REGISTER_DEF,
+		definition.Name+"FSM",
+		definition.PackageName,
+		quote(states),
+		quote(events),
+	)
+}
+
+func GenerateDataDriven(builder *strings.Builder, definition FSMDefinition, states _States, events _Events) {
+	builder.WriteString(MACHINE_DEF)
+	for _, state := range states {
+		fmt.Fprintf(builder, "%v: {\n", _GetStateName(state))
+		for _, eventName := range events {
+			event := definition.Events[eventName]
+			if slices.Contains(event.Source, state) {
+				fmt.Fprintf(builder, "%v: %v,\n", _GetEventName(eventName), _GetStateName(event.Destination))
+			}
+		}
+		builder.WriteString("},\n")
+	}
+	builder.WriteString("}\n")
+
+	if definition.InitialState != "" {
+		fmt.Fprintf(builder, "\nconst MachineInitialState = %v\n", _GetStateName(definition.InitialState))
+	}
+
+	builder.WriteString(MACHINE_APPLY)
+}
+
+func GenerateStringTable(builder *strings.Builder, definition FSMDefinition, states _States, events _Events) {
+	builder.WriteString(STRING_TABLE_DEF)
+	for _, state := range states {
+		fmt.Fprintf(builder, "%q: {\n", state)
+		for _, eventName := range events {
+			event := definition.Events[eventName]
+			if slices.Contains(event.Source, state) {
+				fmt.Fprintf(builder, "%q: %q,\n", eventName, event.Destination)
+			}
+		}
+		builder.WriteString("},\n")
+	}
+	builder.WriteString("}\n")
+}
+
+func GenerateJSON(builder *strings.Builder, definition FSMDefinition) {
+	fields, marshal, unmarshal := strings.Builder{}, strings.Builder{}, strings.Builder{}
+	if _TracksVisits(definition) {
+		fields.WriteString("Visits map[string]uint `json:\",omitempty\"`\n")
+		marshal.WriteString(JSON_MARSHAL_VISITS)
+		unmarshal.WriteString(JSON_UNMARSHAL_VISITS)
+	}
+
+	if _UsesGroups(definition) {
+		groups := []string{}
+		for _, name := range slices.Sorted(maps.Keys(definition.Groups)) {
+			groups = append(groups, fmt.Sprintf("%q", name))
+		}
+		fields.WriteString("FiredGroups []string `json:\",omitempty\"`\n")
+		fmt.Fprintf(&marshal, JSON_MARSHAL_FIRED_GROUPS, strings.Join(groups, ", "))
+		fmt.Fprintf(&unmarshal, JSON_UNMARSHAL_FIRED_GROUPS, strings.Join(groups, ", "))
+	}
+
+	if definition.Pausable {
+		fields.WriteString("Paused bool `json:\",omitempty\"`\n")
+		marshal.WriteString("data.Paused = fsm._Paused\n")
+		unmarshal.WriteString("fsm._Paused = data.Paused\n")
+	}
+
+	fieldInits := strings.Builder{}
+	for _, init := range _GetFieldInits(definition) {
+		fmt.Fprintf(&fieldInits, "if fsm.%v == nil {\nfsm.%v = %v\n}\n", init.Name, init.Name, init.Value)
+	}
+
+	fmt.Fprintf(
+		builder,
+		JSON_DEF,
+		definition.Name,
+		fields.String(),
+		_GetFSMType(definition),
+		definition.Name,
+		marshal.String(),
+		_GetFSMType(definition),
+		definition.Name,
+		unmarshal.String(),
+		fieldInits.String(),
+	)
+}
+
+// _GetDispatchCall type-asserts each of the event's params out of the
+// []any named by params and returns the error of calling it on receiver.
+func _GetDispatchCall(definition FSMDefinition, eventName string, receiver string, params string) string {
+	event := definition.Events[eventName]
+	call := strings.Builder{}
 
-	states := _GetStates(definition)
+	fmt.Fprintf(
+		&call,
+		"if len(%v) != %v {\nreturn fmt.Errorf(\"event %v expects %v params, got %%v\", len(%v))\n}\n",
+		params, len(event.Params), eventName, len(event.Params), params,
+	)
 
-	GenerateHeader(&builder, definition)
-	GenerateStateDefinition(&builder, definition, states)
-	GenerateInitalizer(&builder, definition)
-	GenerateFSMDefinition(&builder, definition)
-	GenerateLookup(&builder, states)
+	args := []string{}
+	for i, param := range event.Params {
+		fmt.Fprintf(
+			&call,
+			"p%v, ok := %v[%v].(%v)\nif !ok {\nreturn fmt.Errorf(\"event %v param %v must be %v, got %%T\", %v[%v])\n}\n",
+			i, params, i, param.Type, eventName, param.Name, param.Type, params, i,
+		)
+		args = append(args, fmt.Sprintf("p%v", i))
+	}
 
-	i := 0
-	for eventName, event := range definition.Events {
-		GenerateFSMEvent(&builder, definition, states, i, eventName, event)
-		i++
+	if definition.DoneCallback {
+		args = append(args, "nil")
 	}
-	return builder.String()
-}
 
-func GenerateHeader(builder *strings.Builder, definition FSMDefinition) {
-	fmt.Fprintf(
-		builder,
-		HEADER,
-		definition.PackageName,
-	)
+	if definition.ReturnEvent {
+		fmt.Fprintf(&call, "_, err := %v.%v(%v)\nreturn err\n", receiver, _GetMethodName(eventName), strings.Join(args, ","))
+	} else {
+		fmt.Fprintf(&call, "return %v.%v(%v)\n", receiver, _GetMethodName(eventName), strings.Join(args, ","))
+	}
+	return call.String()
+}
 
-	if definition.UseSLog {
-		builder.WriteString("\"log/slog\"\n")
+func GenerateRegionResets(builder *strings.Builder, definition FSMDefinition) {
+	for _, name := range slices.Sorted(maps.Keys(definition.Regions)) {
+		fmt.Fprintf(
+			builder,
+			RESET_REGION_DEF,
+			_GetMethodName(name),
+			name,
+			definition.Regions[name].InitialState,
+			_GetFSMType(definition),
+			_GetMethodName(name),
+			_GetStateField(name),
+			_GetStateName(definition.Regions[name].InitialState),
+		)
 	}
+}
 
-	for _, imprt := range definition.Imports {
-		fmt.Fprintf(builder, "\"%v\"\n", imprt)
+func GenerateCurrentState(builder *strings.Builder, definition FSMDefinition, states _States) {
+	regions := _GetStateRegions(definition)
+	cases := strings.Builder{}
+	for _, name := range slices.Sorted(maps.Keys(definition.Regions)) {
+		names := []string{}
+		for _, state := range states {
+			if regions[state] == name {
+				names = append(names, _GetStateName(state))
+			}
+		}
+		fmt.Fprintf(&cases, "case %v:\nreturn fsm.%v\n", strings.Join(names, ", "), _GetStateField(name))
 	}
 
-	builder.WriteRune(')')
+	fmt.Fprintf(builder, CURRENT_STATE_DEF, _GetFSMType(definition), strings.TrimSuffix(cases.String(), "\n"))
 }
 
-func GenerateStateDefinition(builder *strings.Builder, definition FSMDefinition, states _States) {
+// _GetCurrentState is the expression for the current state of the main
+// machine or region that the State named by want belongs to.
+func _GetCurrentState(definition FSMDefinition, receiver string, want string) string {
+	if len(definition.Regions) == 0 {
+		return receiver + ".State"
+	}
+	return fmt.Sprintf("%v._CurrentState(%v)", receiver, want)
+}
 
-	stateEnumType := _GetNeededUintSize(len(states))
+func GenerateApplyAll(builder *strings.Builder, definition FSMDefinition, events _Events) {
+	snapshot, rollback := strings.Builder{}, strings.Builder{}
+	if definition.ApplyAllRollback {
+		snapshot.WriteString("start := fsm.State\n")
+		rollback.WriteString("fsm.State = start\n")
+		for _, name := range slices.Sorted(maps.Keys(definition.Regions)) {
+			field := _GetStateField(name)
+			fmt.Fprintf(&snapshot, "start%v := fsm.%v\n", field, field)
+			fmt.Fprintf(&rollback, "fsm.%v = start%v\n", field, field)
+		}
+		if _TracksVisits(definition) {
+			snapshot.WriteString("visits := maps.Clone(fsm.Visits)\n")
+			rollback.WriteString("fsm.Visits = visits\n")
+		}
+		if _UsesGroups(definition) {
+			snapshot.WriteString("firedGroups := maps.Clone(fsm._FiredGroups)\n")
+			rollback.WriteString("fsm._FiredGroups = firedGroups\n")
+		}
+	}
 
-	state0 := states[0]
+	cases := strings.Builder{}
+	for _, eventName := range events {
+		fmt.Fprintf(&cases, "case %v:\n", _GetEventName(eventName))
+		cases.WriteString(_GetDispatchCall(definition, eventName, "fsm", "call.Params"))
+	}
 
 	fmt.Fprintf(
 		builder,
-		STATES_DEF,
-		stateEnumType,
-		_GetStateName(state0),
+		APPLY_ALL_DEF,
+		_GetFSMType(definition),
+		snapshot.String(),
+		rollback.String(),
+		_GetFSMType(definition),
+		cases.String(),
 	)
+}
 
-	for i, state := range states {
-		if i == 0 {
-			continue
+func GeneratePayloads(builder *strings.Builder, definition FSMDefinition, events _Events) {
+	cases := strings.Builder{}
+	for _, eventName := range events {
+		methodName := _GetMethodName(eventName)
+
+		fields := strings.Builder{}
+		args := []string{}
+		for _, param := range definition.Events[eventName].Params {
+			fmt.Fprintf(&fields, "%v %v\n", _GetMethodName(param.Name), param.Type)
+			args = append(args, "e."+_GetMethodName(param.Name))
 		}
-		builder.WriteString(_GetStateName(state))
-		builder.WriteRune('\n')
-	}
 
-	builder.WriteString("\n)")
+		fmt.Fprintf(
+			builder,
+			PAYLOAD_STRUCT_DEF,
+			methodName, methodName, methodName, fields.String(), methodName, eventName,
+		)
 
-}
+		if definition.DoneCallback {
+			args = append(args, "nil")
+		}
 
-func GenerateFSMDefinition(builder *strings.Builder, definition FSMDefinition) {
-	fmt.Fprintf(
-		builder,
-		FSM_DEF,
-		definition.Name,
-		_GetNeededUintSize(len(definition.Events)),
-	)
+		fmt.Fprintf(&cases, "case %vPayload:\n", methodName)
+		if definition.ReturnEvent {
+			fmt.Fprintf(&cases, "_, err := fsm.%v(%v)\nreturn err\n", methodName, strings.Join(args, ","))
+		} else {
+			fmt.Fprintf(&cases, "return fsm.%v(%v)\n", methodName, strings.Join(args, ","))
+		}
+	}
+
+	fmt.Fprintf(builder, PAYLOAD_DEF, _GetFSMType(definition), cases.String())
 }
 
-func GenerateFSMEvent(builder *strings.Builder, definition FSMDefinition, states _States, index int, eventName string, event FSMEventDefinition) {
+func GenerateFSMEvent(builder *strings.Builder, definition FSMDefinition, eventName string, event FSMEventDefinition) {
+	methodName := _GetMethodName(eventName)
 
 	validSrcs := []string{}
 	signature := []string{}
@@ -156,105 +1850,606 @@ func GenerateFSMEvent(builder *strings.Builder, definition FSMDefinition, states
 		validSrcs = append(validSrcs, _GetStateName(src))
 	}
 
-	logging := ""
-	lsb := strings.Builder{}
-
-	if definition.UseSLog {
-		// lsb.WriteString("slog.With(\"\", ")
-		fmt.Fprintf(&lsb, "slog.With(\"Start State\", fsm.State,")
-	}
+	logArgs := []string{"\"Start State\"", "fsm.State"}
 
 	for _, param := range event.Params {
 		signature = append(signature, fmt.Sprintf("%v %v", param.Name, param.Type))
 		callParams = append(callParams, param.Name)
-		fmt.Fprintf(&lsb, "\"%v\", %v,", param.Name, param.Name)
+		if len(param.LogFields) == 0 {
+			logArgs = append(logArgs, fmt.Sprintf("\"%v\"", param.Name), param.Name)
+			continue
+		}
+		for _, field := range param.LogFields {
+			logArgs = append(logArgs, fmt.Sprintf("\"%v.%v\"", param.Name, field), param.Name+"."+field)
+		}
 	}
 
+	logging := ""
 	if definition.UseSLog {
-		// lsb.WriteString(").Info(\"User has transitioned to %v\")")
-		fmt.Fprintf(
-			&lsb,
-			").Info(\"User has transitioned to %v\")",
+		logging = fmt.Sprintf(
+			"slog.With(%v).Info(\"User has transitioned to %v\")",
+			strings.Join(logArgs, ", "),
 			_GetStateName(eventName),
 		)
-		logging = lsb.String()
+	}
+
+	returnType, errReturn, okReturn := "error", "", "nil"
+	if definition.ReturnEvent {
+		returnType = "(Event, error)"
+		errReturn = _GetEventName(eventName) + ", "
+		okReturn = _GetEventName(eventName) + ", nil"
+	}
+
+	checks := strings.Builder{}
+	stateField := _GetStateField(event.Region)
+
+	methodSignature := slices.Clone(signature)
+
+	if definition.DoneCallback {
+		methodSignature = append(methodSignature, "done func(State, error)")
+		returnType = "(err error)"
+		if definition.ReturnEvent {
+			returnType = "(_ Event, err error)"
+		}
+		fmt.Fprintf(&checks, DONE_CALLBACK_DEFER, stateField)
+	}
+
+	guards := strings.Builder{}
+	preTransition := strings.Builder{}
+	postTransition := strings.Builder{}
+	destination := _GetStateName(event.Destination)
+
+	if definition.Pausable {
+		fmt.Fprintf(&checks, "if fsm._Paused {\nreturn %vErrPaused\n}\n", errReturn)
+	}
+
+	if state := definition.States[event.Destination]; state.MaxVisits > 0 {
+		if state.MaxVisitsFallback != "" {
+			fmt.Fprintf(
+				&guards,
+				"dest := %v\nif fsm.Visits[%v] >= %v {\ndest = %v\n}\n",
+				destination, destination, state.MaxVisits, _GetStateName(state.MaxVisitsFallback),
+			)
+			destination = "dest"
+		} else {
+			fmt.Fprintf(
+				&guards,
+				"if fsm.Visits[%v] >= %v {\nreturn %vfmt.Errorf(\"%%w: %v\", ErrMaxVisits)\n}\n",
+				destination, state.MaxVisits, errReturn, event.Destination,
+			)
+		}
+	}
+
+	if _TracksVisits(definition) {
+		fmt.Fprintf(&postTransition, "fsm.Visits[fsm.%v]++\n", stateField)
+	}
+
+	for _, requirement := range event.Requires {
+		fmt.Fprintf(
+			&guards,
+			"if p := fsm.Providers[%q]; p == nil || p.CurrentState() != %q {\nreturn %vfmt.Errorf(\"%%w: %v requires %v to be %v\", ErrPreconditionFailed)\n}\n",
+			requirement.Provider, requirement.State, errReturn, eventName, requirement.Provider, requirement.State,
+		)
+	}
+
+	if event.Group != "" {
+		fmt.Fprintf(
+			&guards,
+			"if fsm._FiredGroups[%q] {\nreturn %vfmt.Errorf(\"%%w: %v\", ErrGroupLocked)\n}\n",
+			event.Group, errReturn, event.Group,
+		)
+		fmt.Fprintf(&postTransition, "fsm._FiredGroups[%q] = true\n", event.Group)
+	}
+
+	// The veto goes last, so CanTransition only sees transitions that
+	// every other guard already allows.
+	if definition.CanTransition {
+		fmt.Fprintf(&guards, CAN_TRANSITION_CHECK, stateField, destination, eventName, errReturn, errReturn, eventName)
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(definition.Groups)) {
+		if resetOn := definition.Groups[name].ResetOn; resetOn != "" && _UsesGroups(definition) {
+			fmt.Fprintf(
+				&postTransition,
+				"if fsm.%v == %v {\ndelete(fsm._FiredGroups, %q)\n}\n",
+				_GetStateField(_GetStateRegions(definition)[resetOn]), _GetStateName(resetOn), name,
+			)
+		}
+	}
+
+	if definition.EventStream {
+		fmt.Fprintf(&preTransition, "from := fsm.%v\n", stateField)
+		fmt.Fprintf(
+			&postTransition,
+			"fsm._Publish(Transition{%v, from, fsm.%v})\n",
+			_GetEventName(eventName), stateField,
+		)
+	}
+
+	typeParams, typeArgs := _GetTypeParams(definition)
+	hookSignature := slices.Clone(signature)
+	if definition.GenericContext {
+		hookSignature = append([]string{"data *T"}, hookSignature...)
+		callParams = append([]string{"&fsm.Data"}, callParams...)
+	}
+
+	if event.Code != "" {
+		postTransition.WriteString(event.Code)
+		postTransition.WriteRune('\n')
 	}
 
 	ti := []any{}
-	ti = append(ti, eventName)
-	ti = append(ti, strings.Join(signature, ","))
-	ti = append(ti, definition.Name)
-	ti = append(ti, eventName)
-	ti = append(ti, strings.Join(signature, ","))
+	ti = append(ti, methodName)
+	ti = append(ti, typeParams)
+	ti = append(ti, strings.Join(hookSignature, ","))
+	ti = append(ti, methodName)
+	ti = append(ti, _DescribeSources(event.Source))
+	ti = append(ti, event.Destination)
+	ti = append(ti, _GetFSMType(definition))
+	ti = append(ti, methodName)
+	ti = append(ti, strings.Join(methodSignature, ","))
+	ti = append(ti, returnType)
+	ti = append(ti, checks.String())
+	ti = append(ti, stateField)
 	ti = append(ti, strings.Join(validSrcs, ","))
+	ti = append(ti, errReturn)
 	ti = append(ti, eventName)
 	ti = append(ti, "%v")
+	ti = append(ti, stateField)
+	ti = append(ti, guards.String())
 	ti = append(ti, logging)
-	ti = append(ti, index)
-	ti = append(ti, eventName)
+	ti = append(ti, _GetEventName(eventName))
+	ti = append(ti, methodName)
+	ti = append(ti, typeArgs)
 	ti = append(ti, strings.Join(callParams, ","))
-	ti = append(ti, _GetStateName(event.Destination))
-	ti = append(ti, definition.Name)
-	ti = append(ti, eventName)
-	ti = append(ti, eventName)
-	ti = append(ti, index)
+	ti = append(ti, preTransition.String())
+	ti = append(ti, stateField)
+	ti = append(ti, destination)
+	ti = append(ti, postTransition.String())
+	ti = append(ti, okReturn)
+	ti = append(ti, _GetFSMType(definition))
+	ti = append(ti, methodName)
+	ti = append(ti, methodName)
+	ti = append(ti, typeArgs)
+	ti = append(ti, _GetEventName(eventName))
 
 	fmt.Fprintf(
 		builder,
 		EVENT,
 		ti...,
 	)
+
+	if _HasDefaultedParams(event) {
+		GenerateDefaultsWrapper(builder, definition, eventName, event)
+	}
+
+	if definition.MapParams {
+		GenerateMapWrapper(builder, definition, eventName, event)
+	}
+}
+
+func GenerateMapWrapper(builder *strings.Builder, definition FSMDefinition, eventName string, event FSMEventDefinition) {
+	body := strings.Builder{}
+	args := []string{}
+	for i, param := range event.Params {
+		fmt.Fprintf(
+			&body,
+			"v%v, ok := m[%q]\nif !ok {\nreturn fmt.Errorf(\"event %v: missing param %v\")\n}\n",
+			i, param.Name, eventName, param.Name,
+		)
+		fmt.Fprintf(
+			&body,
+			"p%v, ok := v%v.(%v)\nif !ok {\nreturn fmt.Errorf(\"event %v: param %v must be %v, got %%T\", v%v)\n}\n",
+			i, i, param.Type, eventName, param.Name, param.Type, i,
+		)
+		args = append(args, fmt.Sprintf("p%v", i))
+	}
+
+	if definition.DoneCallback {
+		args = append(args, "nil")
+	}
+
+	if definition.ReturnEvent {
+		fmt.Fprintf(&body, "_, err := fsm.%v(%v)\nreturn err\n", _GetMethodName(eventName), strings.Join(args, ","))
+	} else {
+		fmt.Fprintf(&body, "return fsm.%v(%v)\n", _GetMethodName(eventName), strings.Join(args, ","))
+	}
+
+	fmt.Fprintf(
+		builder,
+		MAP_WRAPPER_DEF,
+		_GetMethodName(eventName),
+		_GetMethodName(eventName),
+		_GetFSMType(definition),
+		_GetMethodName(eventName),
+		body.String(),
+	)
+}
+
+func GenerateDefaultsWrapper(builder *strings.Builder, definition FSMDefinition, eventName string, event FSMEventDefinition) {
+	signature := []string{}
+	args := []string{}
+	for _, param := range event.Params {
+		if param.From != "" {
+			args = append(args, "fsm."+param.From)
+			continue
+		}
+		signature = append(signature, fmt.Sprintf("%v %v", param.Name, param.Type))
+		args = append(args, param.Name)
+	}
+
+	if definition.DoneCallback {
+		signature = append(signature, "done func(State, error)")
+		args = append(args, "done")
+	}
+
+	returnType := "error"
+	if definition.ReturnEvent {
+		returnType = "(Event, error)"
+	}
+
+	fmt.Fprintf(
+		builder,
+		DEFAULTS_WRAPPER_DEF,
+		_GetMethodName(eventName),
+		_GetMethodName(eventName),
+		_GetFSMType(definition),
+		_GetMethodName(eventName),
+		strings.Join(signature, ","),
+		returnType,
+		_GetMethodName(eventName),
+		strings.Join(args, ","),
+	)
+}
+
+type _FieldInit struct {
+	Name  string
+	Value string
+}
+
+// _GetFieldInits lists the option-dependent FSM fields NewFSM initialises,
+// which UnmarshalJSON also fills in when unmarshalling into a zero FSM.
+func _GetFieldInits(definition FSMDefinition) []_FieldInit {
+	inits := []_FieldInit{}
+
+	if _TracksVisits(definition) {
+		inits = append(inits, _FieldInit{"Visits", "map[State]uint{}"})
+	}
+
+	if _UsesGroups(definition) {
+		inits = append(inits, _FieldInit{"_FiredGroups", "map[string]bool{}"})
+	}
+
+	if _UsesProviders(definition) {
+		inits = append(inits, _FieldInit{"Providers", "map[string]StateProvider{}"})
+	}
+
+	if definition.EventStream {
+		buffer := definition.EventStreamBuffer
+		if buffer == 0 {
+			buffer = DEFAULT_EVENT_STREAM_BUFFER
+		}
+		inits = append(inits, _FieldInit{"_Events", fmt.Sprintf("make(chan Transition, %v)", buffer)})
+	}
+
+	return inits
 }
 
 func GenerateInitalizer(builder *strings.Builder, definition FSMDefinition) {
+	inits := strings.Builder{}
+
+	for _, name := range slices.Sorted(maps.Keys(definition.Regions)) {
+		fmt.Fprintf(&inits, "%v: %v,\n", _GetStateField(name), _GetStateName(definition.Regions[name].InitialState))
+	}
+
+	for _, init := range _GetFieldInits(definition) {
+		fmt.Fprintf(&inits, "%v: %v,\n", init.Name, init.Value)
+	}
+
+	typeParams, extraParams := "", ""
+	if definition.GenericContext {
+		typeParams, extraParams = "[T any]", ", data T"
+		inits.WriteString("Data: data,\n")
+	}
+
+	for _, field := range definition.Fields {
+		extraParams += fmt.Sprintf(", %v %v", field.Name, field.Type)
+		fmt.Fprintf(&inits, "%v: %v,\n", field.Name, field.Name)
+	}
+
 	fmt.Fprintf(
 		builder,
 		INIT,
-		definition.Name,
-		definition.Name,
-		_GetNeededUintSize(len(definition.Events)),
+		typeParams,
+		extraParams,
+		_GetFSMType(definition),
+		_GetFSMType(definition),
+		inits.String(),
 	)
 }
 
-func GenerateLookup(builder *strings.Builder, states _States) {
+func GenerateLookup(builder *strings.Builder, definition FSMDefinition, states _States) {
+	offset := 0
+	if definition.UnspecifiedState != "" {
+		offset = 1
+	}
+
 	builder.WriteString(LOOKUP_DEF)
 	for i, state := range states {
-		fmt.Fprintf(builder, "%v:\"%v\",\n", i, state)
+		fmt.Fprintf(builder, "%v:\"%v\", // %v\n", i+offset, state, _GetStateName(state))
 	}
 	builder.WriteRune('}')
 }
 
+// RenderDestPath computes the output path for a definition from a
+// template with .Name and .Package available, plus lower and upper funcs.
+func RenderDestPath(text string, definition FSMDefinition) (string, error) {
+	tmpl, err := template.New("dest").
+		Option("missingkey=error").
+		Funcs(template.FuncMap{"lower": strings.ToLower, "upper": strings.ToUpper}).
+		Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	builder := strings.Builder{}
+	err = tmpl.Execute(&builder, map[string]string{
+		"Name":    definition.Name,
+		"Package": definition.PackageName,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	path := strings.TrimSpace(builder.String())
+	if path == "" || strings.ContainsRune(path, 0) || strings.HasSuffix(path, string(filepath.Separator)) {
+		return "", fmt.Errorf("dest template %q produced an invalid path %q", text, path)
+	}
+	return filepath.Clean(path), nil
+}
+
+// RunPostCmd runs the -post-cmd command line once the output is written.
+// It is split on whitespace before each word is executed as a template
+// with .Path, .Name and .Package, so paths with spaces stay one argument.
+// The command's stderr is printed when it succeeds and included in the
+// error when it fails.
+func RunPostCmd(text string, definition FSMDefinition, path string) error {
+	data := map[string]string{
+		"Path":    path,
+		"Name":    definition.Name,
+		"Package": definition.PackageName,
+	}
+
+	args := []string{}
+	for _, word := range strings.Fields(text) {
+		tmpl, err := template.New("post-cmd").Option("missingkey=error").Parse(word)
+		if err != nil {
+			return err
+		}
+		arg := strings.Builder{}
+		if err = tmpl.Execute(&arg, data); err != nil {
+			return err
+		}
+		args = append(args, arg.String())
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("post-cmd %q has no command", text)
+	}
+
+	stderr := strings.Builder{}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("post-cmd %v failed: %w\n%v", strings.Join(args, " "), err, stderr.String())
+	}
+	fmt.Fprint(os.Stderr, stderr.String())
+	return nil
+}
+
+type _VarFlag map[string]string
+
+func (v _VarFlag) String() string {
+	return fmt.Sprint(map[string]string(v))
+}
+
+func (v _VarFlag) Set(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("expected key=value, got %v", s)
+	}
+	v[key] = value
+	return nil
+}
+
 var (
-	TARGET_FILE string
-	DEST_FILE   string
+	VARS = _VarFlag{}
+
+	TARGET_FILE                string
+	DEST_FILE                  string
+	DEST_TEMPLATE              string
+	WARN_DUPLICATE_TRANSITIONS bool
+	WARN_NO_RETURN             bool
+	WERROR                     bool
+	CHANGELOG                  bool
+	REPORT                     string
+	DATA_DRIVEN                bool
+	GENERIC_CONTEXT            bool
+	STRING_TABLE               bool
+	EMIT_TESTS                 bool
+	STRINGER_COMPATIBLE        bool
+	SQL                        bool
+	SCHEMA                     bool
+	POST_CMD                   string
+	FORMAT                     string
 )
 
 func init() {
 	flag.StringVar(&TARGET_FILE, "target-file", "fsm.toml", "FSM definition to generate from")
 	flag.StringVar(&DEST_FILE, "dest-file", "fsm_GEN.go", "File to write generated code too")
-	flag.Parse()
+	flag.StringVar(&FORMAT, "format", "go", "Output to generate: go, params, mermaid, csv or dot")
+	flag.Var(VARS, "var", "Set a ${VAR} used in the definition as key=value, may be repeated")
+	flag.BoolVar(&GENERIC_CONTEXT, "generic-context", false, "Make the FSM generic over a Data type passed to every hook")
+	flag.BoolVar(&SQL, "sql", false, "Make State a sql.Scanner and driver.Valuer using state names")
+	flag.BoolVar(&STRINGER_COMPATIBLE, "stringer-compatible", false, "Give State the String method the stringer tool would generate")
+	flag.BoolVar(&EMIT_TESTS, "emit-tests", false, "Also write a _test.go file with a Given/When/Then scenario builder")
+	flag.BoolVar(&STRING_TABLE, "string-table", false, "Also emit the transition table keyed by state and event names")
+	flag.BoolVar(&DATA_DRIVEN, "data-driven", false, "Also emit the transition table as a Machine map with an Apply function")
+	flag.StringVar(&POST_CMD, "post-cmd", "", "Command run after writing the output, with {{.Path}} as the written file, e.g. \"goimports -w {{.Path}}\"")
+	flag.StringVar(&DEST_TEMPLATE, "dest-template", "", "Go template for the output path using .Name and .Package, ignored when -dest-file is given")
+	flag.BoolVar(&SCHEMA, "schema", false, "Print the JSON Schema of the definition format instead of generating")
+	flag.StringVar(&REPORT, "report", "", "Print every validation finding instead of generating, currently only json")
+	flag.BoolVar(&CHANGELOG, "changelog", false, "Print the changes between the old and new definition files given as arguments")
+	flag.BoolVar(&WERROR, "werror", false, "Fail generation when there are any warnings")
+	flag.BoolVar(&WARN_NO_RETURN, "warn-no-return", false, "Warn about states that can't get back to InitialState")
+	flag.BoolVar(&WARN_DUPLICATE_TRANSITIONS, "warn-duplicate-transitions", false, "Warn about events with identical sources, destination and params")
+}
+
+func _LoadDefinition(path string) (FSMDefinition, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return FSMDefinition{}, err
+	}
+
+	text, err := ExpandVariables(string(raw), VARS)
+	if err != nil {
+		return FSMDefinition{}, err
+	}
+
+	return ParseTOML(strings.NewReader(text))
 }
 
 func main() {
-	f, err := os.Open(TARGET_FILE)
+	flag.Parse()
+
+	if SCHEMA {
+		output, err := RenderSchemaJSON()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(string(output))
+		return
+	}
+
+	if CHANGELOG {
+		if flag.NArg() != 2 {
+			panic(fmt.Errorf("-changelog expects an old and a new definition file"))
+		}
+
+		before, err := _LoadDefinition(flag.Arg(0))
+		if err != nil {
+			panic(err)
+		}
+		after, err := _LoadDefinition(flag.Arg(1))
+		if err != nil {
+			panic(err)
+		}
+
+		fmt.Print(Changelog(before, after))
+		return
+	}
+
+	fsm, err := _LoadDefinition(TARGET_FILE)
 	if err != nil {
 		panic(err)
 	}
 
-	defer f.Close()
+	fsm.DataDriven = DATA_DRIVEN
+	fsm.GenericContext = GENERIC_CONTEXT
+	fsm.StringTable = STRING_TABLE
+	fsm.EmitTests = EMIT_TESTS
+	fsm.StringerCompatible = STRINGER_COMPATIBLE
+	fsm.SQL = SQL
 
-	fsm, err := ParseTOML(f)
-	if err != nil {
+	switch REPORT {
+	case "":
+	case "json":
+		report := BuildReport(fsm)
+		output, err := RenderReportJSON(report)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(string(output))
+		if report.HasErrors {
+			os.Exit(1)
+		}
+		return
+	default:
+		panic(fmt.Errorf("unknown report format %v", REPORT))
+	}
+
+	if err = ValidateDefinition(fsm); err != nil {
 		panic(err)
 	}
 
-	generatedCode := BuildText(fsm)
-	formatted, err := format.Source([]byte(generatedCode))
+	warnings := CheckFinalStatesReachable(fsm)
+
+	if WARN_DUPLICATE_TRANSITIONS {
+		warnings = append(warnings, CheckDuplicateTransitions(fsm)...)
+	}
+
+	if WARN_NO_RETURN {
+		noReturn, err := CheckNoReturn(fsm)
+		if err != nil {
+			panic(err)
+		}
+		warnings = append(warnings, noReturn...)
+	}
+
+	for _, warning := range warnings {
+		fmt.Fprintln(os.Stderr, warning)
+	}
+
+	if WERROR && len(warnings) > 0 {
+		panic(fmt.Errorf("%v warnings treated as errors", len(warnings)))
+	}
+
+	extension, ok := FORMAT_EXTENSIONS[FORMAT]
+	if !ok {
+		panic(fmt.Errorf("unknown format %v", FORMAT))
+	}
+
+	output, err := Render(fsm, FORMAT)
 	if err != nil {
 		panic(err)
 	}
 
-	if err = os.WriteFile(DEST_FILE, formatted, os.ModePerm); err != nil {
+	destFile := DEST_FILE
+	destFileSet := false
+	flag.Visit(func(f *flag.Flag) {
+		destFileSet = destFileSet || f.Name == "dest-file"
+	})
+	if DEST_TEMPLATE != "" && !destFileSet {
+		destFile, err = RenderDestPath(DEST_TEMPLATE, fsm)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// Diagram formats must never land in a .go file unless asked to.
+	if !destFileSet {
+		destFile = strings.TrimSuffix(destFile, ".go") + extension
+	}
+
+	if err = os.WriteFile(destFile, output, os.ModePerm); err != nil {
 		panic(err)
 	}
+
+	if fsm.EmitTests && FORMAT == "go" {
+		testCode, err := format.Source([]byte(BuildTestText(fsm)))
+		if err != nil {
+			panic(err)
+		}
+
+		testFile := strings.TrimSuffix(destFile, ".go") + "_test.go"
+		if err = os.WriteFile(testFile, testCode, os.ModePerm); err != nil {
+			panic(err)
+		}
+	}
+
+	if POST_CMD != "" {
+		if err = RunPostCmd(POST_CMD, fsm, destFile); err != nil {
+			panic(err)
+		}
+	}
 }
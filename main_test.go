@@ -0,0 +1,2577 @@
+package main
+
+import (
+	"go/ast"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestMain runs the generator itself instead of the tests when
+// FSMGEN_RUN_MAIN is set, so tests can check its exit status and output.
+func TestMain(m *testing.M) {
+	if os.Getenv("FSMGEN_RUN_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+const _ORDER_TOML = `
+Name = "Order"
+PackageName = "orders"
+InitialState = "Pending"
+
+[Events.Approve]
+Source = ["Pending"]
+Destination = "Approved"
+
+[Events.Ship]
+Source = ["Approved"]
+Destination = "Shipped"
+[[Events.Ship.Params]]
+Name = "carrier"
+Type = "string"
+
+[Events.Cancel]
+Source = ["Pending", "Approved"]
+Destination = "Cancelled"
+`
+
+func _Parse(t *testing.T, text string) FSMDefinition {
+	t.Helper()
+	definition, err := ParseTOML(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return definition
+}
+
+// _Build validates the definition and returns its gofmt'd Go code.
+func _Build(t *testing.T, definition FSMDefinition) string {
+	t.Helper()
+	if err := ValidateDefinition(definition); err != nil {
+		t.Fatal(err)
+	}
+	output, err := format.Source([]byte(BuildText(definition)))
+	if err != nil {
+		t.Fatalf("generated code does not gofmt: %v\n%v", err, BuildText(definition))
+	}
+	return string(output)
+}
+
+var _IMPORTER = importer.ForCompiler(token.NewFileSet(), "source", nil)
+
+// _TypeCheck type checks generated code as a package of its own, with any
+// support files it needs, and returns the first error found.
+func _TypeCheck(code string, support ...string) error {
+	fset := token.NewFileSet()
+	files := []*ast.File{}
+	for i, source := range append([]string{code}, support...) {
+		file, err := parser.ParseFile(fset, "file"+string(rune('0'+i))+".go", source, 0)
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+	}
+
+	config := types.Config{Importer: _IMPORTER}
+	_, err := config.Check(files[0].Name.Name, fset, files, nil)
+	return err
+}
+
+func _Compiles(t *testing.T, definition FSMDefinition, support ...string) string {
+	t.Helper()
+	code := _Build(t, definition)
+	if err := _TypeCheck(code, support...); err != nil {
+		t.Fatalf("generated code does not type check: %v\n%v", err, code)
+	}
+	return code
+}
+
+// _GoTest runs go test over files in a scratch module that can import
+// this one, returning the combined output.
+func _GoTest(t *testing.T, files map[string]string) (string, error) {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("runs go test on generated code")
+	}
+
+	root, err := filepath.Abs(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum, err := os.ReadFile("go.sum")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	files["go.mod"] = "module example.com/gen\n\ngo 1.24\n\n" +
+		"require github.com/j4d3blooded/go-fsm-codegen v0.0.0\n\n" +
+		"replace github.com/j4d3blooded/go-fsm-codegen => " + root + "\n"
+	files["go.sum"] = string(sum)
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmd := exec.Command("go", "test", "-count=1", "./...")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOPROXY=off", "GOWORK=off")
+	output, err := cmd.CombinedOutput()
+	return string(output), err
+}
+
+// _RunScenario generates the definition and runs testCode, a _test.go
+// file in the generated package, against it.
+func _RunScenario(t *testing.T, definition FSMDefinition, testCode string) {
+	t.Helper()
+	output, err := _GoTest(t, map[string]string{
+		"fsm_GEN.go":       _Build(t, definition),
+		"scenario_test.go": testCode,
+	})
+	if err != nil {
+		t.Fatalf("%v\n%v", err, output)
+	}
+}
+
+// _RunMain runs the generator with args in dir, returning its combined
+// output and whether it succeeded.
+func _RunMain(t *testing.T, dir string, args ...string) (string, error) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "FSMGEN_RUN_MAIN=1")
+	output, err := cmd.CombinedOutput()
+	return string(output), err
+}
+
+func TestSampleDefinitionCompiles(t *testing.T) {
+	raw, err := os.ReadFile("fsm.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_Compiles(t, _Parse(t, string(raw)))
+}
+
+func TestLogFields(t *testing.T) {
+	definition := _Parse(t, `
+Name = "Order"
+PackageName = "orders"
+UseSLog = true
+
+[Events.Pay]
+Source = ["Pending"]
+Destination = "Paid"
+[[Events.Pay.Params]]
+Name = "invoice"
+Type = "Invoice"
+LogFields = ["ID", "Total"]
+[[Events.Pay.Params]]
+Name = "note"
+Type = "string"
+`)
+	code := _Compiles(t, definition, "package orders\ntype Invoice struct { ID int; Total float64 }\n")
+
+	want := `slog.With("Start State", fsm.State, "invoice.ID", invoice.ID, "invoice.Total", invoice.Total, "note", note)`
+	if !strings.Contains(code, want) {
+		t.Fatalf("missing %v in\n%v", want, code)
+	}
+
+	_RunScenario(t, definition, `package orders
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+type Invoice struct {
+	ID    int
+	Total float64
+	Notes string
+}
+
+func TestLogFields(t *testing.T) {
+	buf := bytes.Buffer{}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	fsm := NewFSM(STATE_PENDING)
+	fsm.SetPayHook(func(Invoice, string) {})
+	if err := fsm.Pay(Invoice{ID: 7, Total: 9.5, Notes: "secret"}, "hi"); err != nil {
+		t.Fatal(err)
+	}
+
+	record := map[string]any{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["invoice.ID"] != 7.0 || record["invoice.Total"] != 9.5 || record["note"] != "hi" {
+		t.Fatal(record)
+	}
+	if _, ok := record["invoice"]; ok {
+		t.Fatal("logged the whole struct", record)
+	}
+}
+`)
+}
+
+func TestLogFieldsRejectNonStructParams(t *testing.T) {
+	for _, paramType := range []string{"int", "string", "[]Invoice", "map[string]int", "*float64"} {
+		definition := _Parse(t, `
+Name = "Order"
+PackageName = "orders"
+UseSLog = true
+[Events.Pay]
+Source = ["Pending"]
+Destination = "Paid"
+[[Events.Pay.Params]]
+Name = "invoice"
+Type = "`+paramType+`"
+LogFields = ["ID"]
+`)
+		err := ValidateDefinition(definition)
+		if err == nil || !strings.Contains(err.Error(), "is not a struct") {
+			t.Fatalf("%v: got %v", paramType, err)
+		}
+	}
+}
+
+func TestReturnEvent(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML)
+	definition.ReturnEvent = true
+	code := _Compiles(t, definition)
+	if !strings.Contains(code, "func (fsm *OrderFSM) Ship(carrier string) (Event, error)") {
+		t.Fatalf("Ship does not return its Event\n%v", code)
+	}
+
+	_RunScenario(t, definition, `package orders
+
+import "testing"
+
+func TestReturnEvent(t *testing.T) {
+	fsm := NewFSM(STATE_PENDING)
+	fsm.SetApproveHook(func() {})
+	fsm.SetShipHook(func(string) {})
+
+	if event, err := fsm.Approve(); err != nil || event != EVENT_APPROVE {
+		t.Fatal(event, err)
+	}
+	if event, err := fsm.Ship("post"); err != nil || event != EVENT_SHIP {
+		t.Fatal(event, err)
+	}
+	if event, err := fsm.Approve(); err == nil || event != EVENT_APPROVE {
+		t.Fatal("invalid transitions still report their event", event, err)
+	}
+}
+`)
+}
+
+func TestEventConstantCollisions(t *testing.T) {
+	definition := _Parse(t, `
+Name = "Order"
+PackageName = "orders"
+[Events.ship]
+Source = ["Pending"]
+Destination = "Shipped"
+[Events.SHIP]
+Source = ["Approved"]
+Destination = "Shipped"
+`)
+	err := ValidateDefinition(definition)
+	if err == nil || !strings.Contains(err.Error(), "both generate the constant EVENT_SHIP") {
+		t.Fatal(err)
+	}
+}
+
+func TestStateConstantCollisions(t *testing.T) {
+	definition := _Parse(t, `
+Name = "Order"
+PackageName = "orders"
+[Events.Ship]
+Source = ["pending"]
+Destination = "Pending"
+`)
+	err := ValidateDefinition(definition)
+	if err == nil || !strings.Contains(err.Error(), "both generate the constant STATE_PENDING") {
+		t.Fatal(err)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML)
+	definition.EventStream = true
+	definition.EventStreamBuffer = 1
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package orders
+
+import "testing"
+
+func TestEventsInOrder(t *testing.T) {
+	fsm := NewFSM(STATE_PENDING)
+	fsm.SetApproveHook(func() {})
+	fsm.SetShipHook(func(string) {})
+
+	received := make(chan []Transition)
+	go func() {
+		transitions := []Transition{}
+		for transition := range fsm.Events() {
+			transitions = append(transitions, transition)
+		}
+		received <- transitions
+	}()
+
+	fsm.Approve()
+	fsm.Approve()
+	fsm.Ship("post")
+	fsm.StopEvents()
+	fsm.StopEvents()
+
+	got := <-received
+	want := []Transition{
+		{EVENT_APPROVE, STATE_PENDING, STATE_APPROVED},
+		{EVENT_SHIP, STATE_APPROVED, STATE_SHIPPED},
+	}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatal(got)
+	}
+
+	fsm.State = STATE_PENDING
+	if err := fsm.Approve(); err != nil {
+		t.Fatal("transitions after StopEvents must not block", err)
+	}
+}
+`)
+
+	definition.EventStreamPolicy = "drop-oldest"
+	_RunScenario(t, definition, `package orders
+
+import "testing"
+
+func TestDropOldest(t *testing.T) {
+	fsm := NewFSM(STATE_PENDING)
+	fsm.SetApproveHook(func() {})
+	fsm.SetShipHook(func(string) {})
+
+	fsm.Approve()
+	fsm.Ship("post")
+
+	if got := <-fsm.Events(); got != (Transition{EVENT_SHIP, STATE_APPROVED, STATE_SHIPPED}) {
+		t.Fatal("the newest transition should be kept", got)
+	}
+}
+`)
+}
+
+func TestEventStreamRejectsUnknownPolicy(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML)
+	definition.EventStream = true
+	definition.EventStreamPolicy = "drop-newest"
+	if err := ValidateDefinition(definition); err == nil {
+		t.Fatal("accepted an unknown EventStreamPolicy")
+	}
+}
+
+func TestCheckDuplicateTransitions(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML+`
+[Events.Reject]
+Source = ["Approved", "Pending"]
+Destination = "Cancelled"
+
+[Events.Dispatch]
+Source = ["Approved"]
+Destination = "Shipped"
+[[Events.Dispatch.Params]]
+Name = "courier"
+Type = "string"
+`)
+
+	warnings := CheckDuplicateTransitions(definition)
+	if len(warnings) != 1 {
+		t.Fatal(warnings)
+	}
+	if !slices.Equal(warnings[0].Events, []string{"Cancel", "Reject"}) {
+		t.Fatal("sources should match regardless of order", warnings[0].Events)
+	}
+	if warnings[0].Message != "events Cancel, Reject share the transition Approved,Pending -> Cancelled ()" {
+		t.Fatal(warnings[0].Message)
+	}
+}
+
+func TestApplyAll(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML)
+	definition.ApplyAll = true
+	_Compiles(t, definition)
+
+	scenario := `package orders
+
+import "testing"
+
+func TestApplyAll(t *testing.T) {
+	fsm := NewFSM(STATE_PENDING)
+	fsm.SetApproveHook(func() {})
+	var carrier string
+	fsm.SetShipHook(func(c string) { carrier = c })
+
+	err := fsm.ApplyAll([]EventCall{{Event: EVENT_APPROVE}, {Event: EVENT_SHIP, Params: []any{"post"}}})
+	if err != nil || fsm.State != STATE_SHIPPED || carrier != "post" {
+		t.Fatal(err, fsm.State, carrier)
+	}
+}
+
+func TestApplyAllFailsMidway(t *testing.T) {
+	fsm := NewFSM(STATE_PENDING)
+	fsm.SetApproveHook(func() {})
+	fsm.SetShipHook(func(string) {})
+
+	err := fsm.ApplyAll([]EventCall{{Event: EVENT_APPROVE}, {Event: EVENT_SHIP, Params: []any{42}}, {Event: EVENT_CANCEL}})
+	if err == nil || err.Error() != "batch event 1 failed: event Ship param carrier must be string, got int" {
+		t.Fatal(err)
+	}
+	if fsm.State != WANT_STATE {
+		t.Fatal(fsm.State)
+	}
+}
+`
+	_RunScenario(t, definition, strings.ReplaceAll(scenario, "WANT_STATE", "STATE_APPROVED"))
+
+	definition.ApplyAllRollback = true
+	_RunScenario(t, definition, strings.ReplaceAll(scenario, "WANT_STATE", "STATE_PENDING"))
+}
+
+func TestDataDriven(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML)
+	definition.DataDriven = true
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package orders
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMachine(t *testing.T) {
+	want := map[State]map[Event]State{
+		STATE_PENDING:   {EVENT_APPROVE: STATE_APPROVED, EVENT_CANCEL: STATE_CANCELLED},
+		STATE_APPROVED:  {EVENT_SHIP: STATE_SHIPPED, EVENT_CANCEL: STATE_CANCELLED},
+		STATE_CANCELLED: {},
+		STATE_SHIPPED:   {},
+	}
+	if !reflect.DeepEqual(Machine, want) {
+		t.Fatal(Machine)
+	}
+	if MachineInitialState != STATE_PENDING {
+		t.Fatal(MachineInitialState)
+	}
+}
+
+func TestApply(t *testing.T) {
+	if s, err := Apply(STATE_PENDING, EVENT_APPROVE); err != nil || s != STATE_APPROVED {
+		t.Fatal(s, err)
+	}
+	if s, err := Apply(STATE_SHIPPED, EVENT_CANCEL); err == nil || s != STATE_SHIPPED {
+		t.Fatal("invalid events must leave the state alone", s, err)
+	}
+}
+`)
+}
+
+func TestEventIndicesCheck(t *testing.T) {
+	code := _Build(t, _Parse(t, _ORDER_TOML))
+	intact := "\tEVENT_APPROVE,\n\tEVENT_CANCEL,\n\tEVENT_SHIP,\n}"
+	if !strings.Contains(code, intact) {
+		t.Fatalf("missing the event index table\n%v", code)
+	}
+
+	broken := strings.Replace(code, intact, "\tEVENT_APPROVE,\n\tEVENT_SHIP,\n\tEVENT_SHIP,\n}", 1)
+	output, err := _GoTest(t, map[string]string{
+		"fsm_GEN.go":       broken,
+		"scenario_test.go": "package orders\n\nimport \"testing\"\n\nfunc TestNothing(t *testing.T) {}\n",
+	})
+	if err == nil || !strings.Contains(output, "event index 2 found at position 1") {
+		t.Fatalf("a broken index table should panic at init: %v\n%v", err, output)
+	}
+}
+
+func TestExpandVariables(t *testing.T) {
+	t.Setenv("FSMGEN_PACKAGE", "fromenv")
+	t.Setenv("FSMGEN_NAME", "Env")
+
+	text := `Name="${FSMGEN_NAME}" PackageName="${FSMGEN_PACKAGE}" Imports=["${FSMGEN_IMPORT:-time}"]`
+	got, err := ExpandVariables(text, map[string]string{"FSMGEN_NAME": "Var"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != `Name="Var" PackageName="fromenv" Imports=["time"]` {
+		t.Fatal(got)
+	}
+
+	_, err = ExpandVariables("${FSMGEN_UNSET} ${FSMGEN_OTHER} ${FSMGEN_UNSET}", nil)
+	if err == nil || err.Error() != "unset variables: FSMGEN_UNSET, FSMGEN_OTHER" {
+		t.Fatal(err)
+	}
+}
+
+func TestVarFlag(t *testing.T) {
+	dir := t.TempDir()
+	toml := strings.Replace(_ORDER_TOML, `PackageName = "orders"`, `PackageName = "${PACKAGE}"`, 1)
+	if err := os.WriteFile(filepath.Join(dir, "fsm.toml"), []byte(toml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if output, err := _RunMain(t, dir, "-var", "PACKAGE=shipping"); err != nil {
+		t.Fatal(err, output)
+	}
+	code, err := os.ReadFile(filepath.Join(dir, "fsm_GEN.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(code), "package shipping") {
+		t.Fatal(string(code))
+	}
+
+	if output, err := _RunMain(t, dir); err == nil || !strings.Contains(output, "unset variables: PACKAGE") {
+		t.Fatal("expected an unset variable error", err, output)
+	}
+}
+
+const _RETRY_TOML = `
+Name = "Job"
+PackageName = "jobs"
+
+[States.Retrying]
+MaxVisits = 2
+
+[Events.Fail]
+Source = ["Running"]
+Destination = "Retrying"
+
+[Events.Retry]
+Source = ["Retrying"]
+Destination = "Running"
+`
+
+func TestMaxVisits(t *testing.T) {
+	definition := _Parse(t, _RETRY_TOML)
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package jobs
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMaxVisits(t *testing.T) {
+	fsm := NewFSM(STATE_RUNNING)
+	fsm.SetFailHook(func() {})
+	fsm.SetRetryHook(func() {})
+
+	for range 2 {
+		if err := fsm.Fail(); err != nil {
+			t.Fatal(err)
+		}
+		fsm.Retry()
+	}
+
+	if err := fsm.Fail(); !errors.Is(err, ErrMaxVisits) || fsm.State != STATE_RUNNING {
+		t.Fatal("a third visit should be blocked", err, fsm.State)
+	}
+	if fsm.Visits[STATE_RETRYING] != 2 {
+		t.Fatal(fsm.Visits)
+	}
+}
+`)
+
+	definition = _Parse(t, strings.Replace(_RETRY_TOML, "MaxVisits = 2", "MaxVisits = 1\nMaxVisitsFallback = \"Failed\"", 1)+`
+[Events.GiveUp]
+Source = ["Failed"]
+Destination = "Failed"
+`)
+	_RunScenario(t, definition, `package jobs
+
+import "testing"
+
+func TestMaxVisitsFallback(t *testing.T) {
+	fsm := NewFSM(STATE_RUNNING)
+	fsm.SetFailHook(func() {})
+	fsm.SetRetryHook(func() {})
+
+	fsm.Fail()
+	fsm.Retry()
+	if err := fsm.Fail(); err != nil || fsm.State != STATE_FAILED {
+		t.Fatal("a second visit should route to Failed", err, fsm.State)
+	}
+}
+`)
+}
+
+func TestMaxVisitsFallbackNeedsMaxVisits(t *testing.T) {
+	definition := _Parse(t, strings.Replace(_RETRY_TOML, "MaxVisits = 2", "MaxVisitsFallback = \"Running\"", 1))
+	err := ValidateDefinition(definition)
+	if err == nil || err.Error() != "States.Retrying has MaxVisitsFallback without MaxVisits" {
+		t.Fatal(err)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	definition := _Parse(t, _RETRY_TOML)
+	definition.JSON = true
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package jobs
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	fsm := NewFSM(STATE_RUNNING)
+	fsm.SetFailHook(func() {})
+	fsm.SetRetryHook(func() {})
+	fsm.Fail()
+	fsm.Retry()
+	fsm.Fail()
+
+	b, err := json.Marshal(fsm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `+"`"+`{"State":"Retrying","Visits":{"Retrying":2,"Running":1}}`+"`"+` {
+		t.Fatal(string(b))
+	}
+
+	restored := NewFSM(STATE_RUNNING)
+	if err := json.Unmarshal(b, restored); err != nil {
+		t.Fatal(err)
+	}
+	if restored.State != fsm.State || !reflect.DeepEqual(restored.Visits, fsm.Visits) {
+		t.Fatal(restored)
+	}
+}
+
+func TestUnmarshalValidates(t *testing.T) {
+	for _, b := range []string{
+		`+"`"+`{"State":"Sleeping"}`+"`"+`,
+		`+"`"+`{"State":"Running","Visits":{"Sleeping":1}}`+"`"+`,
+		`+"`"+`{"State":"Running","Visits":{"Retrying":-1}}`+"`"+`,
+	} {
+		fsm := JobFSM{}
+		if err := json.Unmarshal([]byte(b), &fsm); err == nil {
+			t.Fatal("accepted", b)
+		}
+	}
+}
+`)
+}
+
+func TestUnmarshalJSONIntoZeroFSM(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML+`
+[Groups.review]
+`)
+	review := definition.Events["Approve"]
+	review.Group = "review"
+	definition.Events["Approve"] = review
+	definition.JSON = true
+	definition.EventStream = true
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package orders
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestUnmarshalIntoZeroFSM(t *testing.T) {
+	var fsm OrderFSM
+	if err := json.Unmarshal([]byte(`+"`"+`{"State":"Pending"}`+"`"+`), &fsm); err != nil {
+		t.Fatal(err)
+	}
+	fsm.SetApproveHook(func() {})
+	if err := fsm.Approve(); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-fsm.Events(); got.To != STATE_APPROVED {
+		t.Fatal(got)
+	}
+}
+`)
+}
+
+func TestEventCollidesWithGeneratedMember(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML+`
+[Events.pause]
+Source = ["Pending"]
+Destination = "Pending"
+`)
+	if err := ValidateDefinition(definition); err != nil {
+		t.Fatal("Pause is only reserved with Pausable", err)
+	}
+
+	definition.Pausable = true
+	err := ValidateDefinition(definition)
+	if err == nil || err.Error() != "event pause collides with a generated member of OrderFSM, consider renaming it to pauseEvent" {
+		t.Fatal(err)
+	}
+
+	definition = _Parse(t, _ORDER_TOML+`
+[Events.SetShipHook]
+Source = ["Pending"]
+Destination = "Pending"
+`)
+	if err := ValidateDefinition(definition); err == nil {
+		t.Fatal("accepted an event colliding with a hook setter")
+	}
+}
+
+func TestPausable(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML)
+	definition.Pausable = true
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package orders
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPause(t *testing.T) {
+	fsm := NewFSM(STATE_PENDING)
+	fsm.SetApproveHook(func() {})
+
+	fsm.Pause()
+	if err := fsm.Approve(); !errors.Is(err, ErrPaused) || fsm.State != STATE_PENDING || !fsm.Paused() {
+		t.Fatal(err, fsm.State)
+	}
+
+	fsm.Resume()
+	if err := fsm.Approve(); err != nil || fsm.State != STATE_APPROVED || fsm.Paused() {
+		t.Fatal(err, fsm.State)
+	}
+}
+`)
+}
+
+func TestPausedSurvivesJSON(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML)
+	definition.Pausable = true
+	definition.JSON = true
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package orders
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	fsm := NewFSM(STATE_PENDING)
+	fsm.Pause()
+
+	b, err := json.Marshal(fsm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `+"`"+`{"State":"Pending","Paused":true}`+"`"+` {
+		t.Fatal(string(b))
+	}
+
+	var restored OrderFSM
+	if err := json.Unmarshal(b, &restored); err != nil {
+		t.Fatal(err)
+	}
+	restored.SetApproveHook(func() {})
+	if err := restored.Approve(); !errors.Is(err, ErrPaused) || !restored.Paused() {
+		t.Fatal("the restored FSM should still be paused", err)
+	}
+
+	restored.Resume()
+	if b, _ := json.Marshal(&restored); string(b) != `+"`"+`{"State":"Pending"}`+"`"+` {
+		t.Fatal(string(b))
+	}
+}
+`)
+}
+
+func TestUnspecifiedState(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML)
+	definition.UnspecifiedState = "Unspecified"
+	definition.StringerCompatible = true
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package orders
+
+import "testing"
+
+func TestZeroFSMIsInvalid(t *testing.T) {
+	var fsm OrderFSM
+	if fsm.State != STATE_UNSPECIFIED || fsm.State.IsValid() {
+		t.Fatal("a zero FSM should be invalid", fsm.State)
+	}
+	if fsm.State.String() != "STATE_UNSPECIFIED" {
+		t.Fatal(fsm.State.String())
+	}
+	if _, ok := FSM_STATE_NAME_LOOKUP[STATE_UNSPECIFIED]; ok {
+		t.Fatal("the unspecified state should not be looked up by name")
+	}
+
+	fsm = *NewFSM(STATE_PENDING)
+	if STATE_PENDING == 0 || !fsm.State.IsValid() || FSM_STATE_NAME_LOOKUP[fsm.State] != "Pending" {
+		t.Fatal(fsm.State)
+	}
+}
+`)
+
+	for unspecified, want := range map[string]string{
+		"Pending":   "UnspecifiedState Pending is also used as a real state",
+		"pending":   "UnspecifiedState pending and state Pending both generate the constant STATE_PENDING",
+		"not-set":   `UnspecifiedState "not-set" is not a valid Go identifier`,
+		"Not Ready": `UnspecifiedState "Not Ready" is not a valid Go identifier`,
+	} {
+		definition.UnspecifiedState = unspecified
+		err := ValidateDefinition(definition)
+		if err == nil || err.Error() != want {
+			t.Fatal(unspecified, err)
+		}
+	}
+}
+
+func TestDoneCallback(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML)
+	definition.DoneCallback = true
+	_Compiles(t, definition)
+	definition.ReturnEvent = true
+	_Compiles(t, definition)
+	definition.ReturnEvent = false
+
+	_RunScenario(t, definition, `package orders
+
+import "testing"
+
+func TestDone(t *testing.T) {
+	fsm := NewFSM(STATE_PENDING)
+	fsm.SetApproveHook(func() {})
+	fsm.SetShipHook(func(string) {})
+
+	var gotState State
+	var gotErr error
+	calls := 0
+	done := func(s State, err error) {
+		gotState, gotErr = s, err
+		calls++
+	}
+
+	if err := fsm.Approve(done); err != nil || calls != 1 || gotState != STATE_APPROVED || gotErr != nil {
+		t.Fatal(err, calls, gotState, gotErr)
+	}
+
+	err := fsm.Approve(done)
+	if err == nil || calls != 2 || gotState != STATE_APPROVED || gotErr != err {
+		t.Fatal("failures should reach done too", err, calls, gotState, gotErr)
+	}
+
+	if err := fsm.Ship("post", nil); err != nil {
+		t.Fatal("a nil done should be ignored", err)
+	}
+}
+`)
+}
+
+func TestGenericContext(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML)
+	definition.GenericContext = true
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package orders
+
+import "testing"
+
+type Tenant struct {
+	ID      string
+	Shipped []string
+}
+
+func TestGenericData(t *testing.T) {
+	fsm := NewFSM(STATE_APPROVED, Tenant{ID: "acme"})
+	fsm.SetShipHook(func(tenant *Tenant, carrier string) {
+		tenant.Shipped = append(tenant.Shipped, tenant.ID+":"+carrier)
+	})
+
+	if err := fsm.Ship("post"); err != nil {
+		t.Fatal(err)
+	}
+	if len(fsm.Data.Shipped) != 1 || fsm.Data.Shipped[0] != "acme:post" {
+		t.Fatal(fsm.Data)
+	}
+}
+`)
+}
+
+func TestOrder(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML)
+	definition.Order = []string{"Ship", "Approve", "Cancel"}
+	code := _Compiles(t, definition)
+
+	ship := strings.Index(code, "func (fsm *OrderFSM) Ship(")
+	approve := strings.Index(code, "func (fsm *OrderFSM) Approve(")
+	cancel := strings.Index(code, "func (fsm *OrderFSM) Cancel(")
+	if ship < 0 || !(ship < approve && approve < cancel) {
+		t.Fatal("methods are not in Order", ship, approve, cancel)
+	}
+	if !strings.Contains(code, "EVENT_SHIP Event = iota") {
+		t.Fatal("constants are not in Order")
+	}
+
+	for order, want := range map[string]string{
+		"Ship, Approve":                "Order is missing event Cancel",
+		"Ship, Approve, Cancel, Ship":  "Order lists event Ship more than once",
+		"Ship, Approve, Cancel, Print": "Order lists unknown event Print",
+	} {
+		definition.Order = strings.Split(order, ", ")
+		if err := ValidateDefinition(definition); err == nil || err.Error() != want {
+			t.Fatal(order, err)
+		}
+	}
+}
+
+func TestExpectState(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML)
+	definition.ExpectState = true
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package orders
+
+import "testing"
+
+func TestExpectState(t *testing.T) {
+	fsm := NewFSM(STATE_PENDING)
+	if err := fsm.ExpectState(STATE_PENDING); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsm.ExpectState(STATE_SHIPPED); err == nil || err.Error() != "got Pending, want Shipped" {
+		t.Fatal(err)
+	}
+	fsm.State = 42
+	if err := fsm.ExpectState(STATE_SHIPPED); err == nil || err.Error() != "got State(42), want Shipped" {
+		t.Fatal(err)
+	}
+}
+`)
+}
+
+func TestRenderDestPath(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML)
+
+	got, err := RenderDestPath("gen/{{.Package}}/{{lower .Name}}_state_GEN.go", definition)
+	if err != nil || got != filepath.Join("gen", "orders", "order_state_GEN.go") {
+		t.Fatal(got, err)
+	}
+
+	for _, text := range []string{"{{.Missing}}.go", "  ", "{{.Package}}/", "{{if}}"} {
+		if got, err := RenderDestPath(text, definition); err == nil {
+			t.Fatalf("%q gave %q", text, got)
+		}
+	}
+}
+
+func TestDestFileOverridesDestTemplate(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "fsm.toml"), []byte(_ORDER_TOML), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if output, err := _RunMain(t, dir, "-dest-template", "{{lower .Name}}_GEN.go"); err != nil {
+		t.Fatal(err, output)
+	}
+	if output, err := _RunMain(t, dir, "-dest-template", "{{lower .Name}}_GEN.go", "-dest-file", "explicit.go"); err != nil {
+		t.Fatal(err, output)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if !slices.Equal(names, []string{"explicit.go", "fsm.toml", "order_GEN.go"}) {
+		t.Fatal(names)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML)
+	definition.Register = true
+	code := _Build(t, definition)
+
+	output, err := _GoTest(t, map[string]string{
+		"a/orders/fsm_GEN.go": code,
+		"b/orders/fsm_GEN.go": code,
+		"registry_test.go": `package gen
+
+import (
+	"testing"
+
+	_ "example.com/gen/a/orders"
+	_ "example.com/gen/b/orders"
+	"github.com/j4d3blooded/go-fsm-codegen/fsmregistry"
+)
+
+func TestRegistered(t *testing.T) {
+	infos := fsmregistry.All()
+	if len(infos) != 2 {
+		t.Fatal(infos)
+	}
+	for i, path := range []string{"example.com/gen/a/orders", "example.com/gen/b/orders"} {
+		info := infos[i]
+		if info.Path != path || info.Name != "OrderFSM" || info.Package != "orders" {
+			t.Fatal(info)
+		}
+		if len(info.States) != 4 || len(info.Events) != 3 || info.Events[0] != "Approve" {
+			t.Fatal(info)
+		}
+	}
+}
+`,
+	})
+	if err != nil {
+		t.Fatalf("%v\n%v", err, output)
+	}
+}
+
+func TestCompactEvents(t *testing.T) {
+	definition := _Parse(t, `
+name = "Order"
+packageName = "orders"
+
+[events]
+approve = { source = ["Pending"], destination = "Approved" }
+ship = { source = ["Approved"], destination = "Shipped", params = [{ name = "carrier", type = "string" }] }
+`)
+	code := _Compiles(t, definition)
+
+	for _, want := range []string{
+		"func (fsm *OrderFSM) Approve() error {",
+		"type EventApproveHook func()\n",
+		"hook()\n",
+		"func (fsm *OrderFSM) Ship(carrier string) error {",
+	} {
+		if !strings.Contains(code, want) {
+			t.Fatalf("missing %q in\n%v", want, code)
+		}
+	}
+}
+
+func TestWerror(t *testing.T) {
+	dir := t.TempDir()
+	toml := `FinalStates = ["Archived"]` + _ORDER_TOML + `
+[Events.Archive]
+Source = ["Archived"]
+Destination = "Archived"
+`
+	if err := os.WriteFile(filepath.Join(dir, "fsm.toml"), []byte(toml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := _RunMain(t, dir)
+	if err != nil || !strings.Contains(output, "warning: final state Archived is unreachable from Pending") {
+		t.Fatal("warnings alone should not fail generation", err, output)
+	}
+
+	output, err = _RunMain(t, dir, "-werror")
+	if err == nil || !strings.Contains(output, "1 warnings treated as errors") {
+		t.Fatal(err, output)
+	}
+}
+
+func TestWouldChange(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML+`
+[Events.Remind]
+Source = ["Pending"]
+Destination = "Pending"
+`)
+	definition.WouldChange = true
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package orders
+
+import "testing"
+
+func TestWouldChange(t *testing.T) {
+	fsm := NewFSM(STATE_PENDING)
+	for event, want := range map[string]bool{
+		"Remind":  false,
+		"Approve": true,
+		"Ship":    false,
+		"Unknown": false,
+	} {
+		if got := fsm.WouldChange(event); got != want {
+			t.Fatal(event, got)
+		}
+	}
+}
+`)
+}
+
+func TestWithDefaults(t *testing.T) {
+	definition := _Parse(t, `Fields = [{ Name = "Tenant", Type = "string" }]`+_ORDER_TOML+`
+[[Events.Ship.Params]]
+Name = "tenant"
+Type = "string"
+From = "Tenant"
+`)
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package orders
+
+import "testing"
+
+func TestWithDefaults(t *testing.T) {
+	fsm := NewFSM(STATE_APPROVED, "acme")
+	var got string
+	fsm.SetShipHook(func(carrier, tenant string) { got = carrier + "@" + tenant })
+
+	if err := fsm.ShipWithDefaults("post"); err != nil || got != "post@acme" {
+		t.Fatal(err, got)
+	}
+}
+`)
+
+	ship := definition.Events["Ship"]
+	ship.Params[1].Type = "int"
+	if err := ValidateDefinition(definition); err == nil {
+		t.Fatal("accepted a From field of another type")
+	}
+	ship.Params[1].From = "Region"
+	if err := ValidateDefinition(definition); err == nil {
+		t.Fatal("accepted an undeclared From field")
+	}
+}
+
+func _SetGroup(definition FSMDefinition, group string, events ...string) {
+	for _, eventName := range events {
+		event := definition.Events[eventName]
+		event.Group = group
+		definition.Events[eventName] = event
+	}
+}
+
+func TestGroups(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML+`
+[Events.Reopen]
+Source = ["Approved", "Cancelled"]
+Destination = "Pending"
+
+[Groups.decision]
+ResetOn = "Pending"
+`)
+	_Compiles(t, definition)
+
+	_SetGroup(definition, "undecided", "Approve")
+	err := ValidateDefinition(definition)
+	if err == nil || err.Error() != "event Approve: Group undecided is not declared in Groups" {
+		t.Fatal(err)
+	}
+
+	_SetGroup(definition, "decision", "Approve", "Cancel")
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package orders
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestGroupLocksUntilReset(t *testing.T) {
+	fsm := NewFSM(STATE_PENDING)
+	fsm.SetApproveHook(func() {})
+	fsm.SetCancelHook(func() {})
+	fsm.SetReopenHook(func() {})
+
+	if err := fsm.Approve(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsm.Cancel(); !errors.Is(err, ErrGroupLocked) {
+		t.Fatal("cancel after approve should be locked", err)
+	}
+	if fsm.State != STATE_APPROVED {
+		t.Fatal(fsm.State)
+	}
+
+	if err := fsm.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsm.Cancel(); err != nil {
+		t.Fatal("entering Pending should unlock the group", err)
+	}
+}
+`)
+}
+
+func TestFiredGroupsSurviveJSON(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML+`
+[Events.Reopen]
+Source = ["Approved", "Cancelled"]
+Destination = "Pending"
+
+[Groups.decision]
+ResetOn = "Pending"
+`)
+	_SetGroup(definition, "decision", "Approve", "Cancel")
+	definition.JSON = true
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package orders
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	fsm := NewFSM(STATE_PENDING)
+	fsm.SetApproveHook(func() {})
+	if err := fsm.Approve(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(fsm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `+"`"+`{"State":"Approved","FiredGroups":["decision"]}`+"`"+` {
+		t.Fatal(string(b))
+	}
+
+	var restored OrderFSM
+	if err := json.Unmarshal(b, &restored); err != nil {
+		t.Fatal(err)
+	}
+	restored.SetCancelHook(func() {})
+	restored.SetReopenHook(func() {})
+	if err := restored.Cancel(); !errors.Is(err, ErrGroupLocked) {
+		t.Fatal("the restored FSM should keep the group locked", err)
+	}
+	if err := restored.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Cancel(); err != nil {
+		t.Fatal("entering Pending should unlock the restored group", err)
+	}
+}
+
+func TestUnmarshalUnknownGroup(t *testing.T) {
+	var fsm OrderFSM
+	if err := json.Unmarshal([]byte(`+"`"+`{"State":"Pending","FiredGroups":["review"]}`+"`"+`), &fsm); err == nil {
+		t.Fatal("accepted an undeclared group")
+	}
+}
+`)
+}
+
+func TestApplyAllRollbackRestoresGroupsAndVisits(t *testing.T) {
+	definition := _Parse(t, _RETRY_TOML+`
+[Groups.attempt]
+ResetOn = "Running"
+`)
+	_SetGroup(definition, "attempt", "Fail")
+	definition.ApplyAll = true
+	definition.ApplyAllRollback = true
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package jobs
+
+import "testing"
+
+func TestRollback(t *testing.T) {
+	fsm := NewFSM(STATE_RUNNING)
+	fsm.SetFailHook(func() {})
+	fsm.SetRetryHook(func() {})
+
+	if err := fsm.ApplyAll([]EventCall{{Event: EVENT_FAIL}, {Event: EVENT_FAIL}}); err == nil {
+		t.Fatal("second Fail should not be valid from Retrying")
+	}
+	if fsm.State != STATE_RUNNING || fsm.Visits[STATE_RETRYING] != 0 {
+		t.Fatal(fsm.State, fsm.Visits)
+	}
+	if err := fsm.Fail(); err != nil {
+		t.Fatal("the rolled back Fail should not lock its group", err)
+	}
+}
+`)
+}
+
+func TestRequires(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML+`
+[[Events.Ship.Requires]]
+Provider = "warehouse"
+State = "Packed"
+`)
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package orders
+
+import (
+	"errors"
+	"testing"
+)
+
+type warehouse struct{ state string }
+
+func (w *warehouse) CurrentState() string { return w.state }
+
+func TestPreconditionBlocksUntilProviderIsReady(t *testing.T) {
+	fsm := NewFSM(STATE_APPROVED)
+	fsm.SetShipHook(func(string) {})
+
+	if err := fsm.Ship("post"); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatal("a missing provider should fail the precondition", err)
+	}
+
+	w := &warehouse{"Picking"}
+	fsm.Providers["warehouse"] = w
+	err := fsm.Ship("post")
+	if !errors.Is(err, ErrPreconditionFailed) || err.Error() != "precondition failed: Ship requires warehouse to be Packed" {
+		t.Fatal(err)
+	}
+	if fsm.State != STATE_APPROVED {
+		t.Fatal(fsm.State)
+	}
+
+	w.state = "Packed"
+	if err := fsm.Ship("post"); err != nil || fsm.State != STATE_SHIPPED {
+		t.Fatal(err, fsm.State)
+	}
+}
+`)
+
+	definition.Events["Ship"].Requires[0].State = ""
+	err := ValidateDefinition(definition)
+	if err == nil || err.Error() != "event Ship: Requires entries need both Provider and State" {
+		t.Fatal(err)
+	}
+}
+
+func TestEmitTestsScenario(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML)
+	definition.EmitTests = true
+	testCode, err := format.Source([]byte(BuildTestText(definition)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := _GoTest(t, map[string]string{
+		"fsm_GEN.go":      _Build(t, definition),
+		"fsm_GEN_test.go": string(testCode),
+		"scenario_test.go": `package orders
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestScenarioDrivesTransitions(t *testing.T) {
+	s := Given(t, STATE_PENDING).When("Approve").Then(STATE_APPROVED).When("Ship", "post").Then(STATE_SHIPPED)
+	if s.FSM.State != STATE_SHIPPED {
+		t.Fatal(s.FSM.State)
+	}
+}
+
+type recorder struct {
+	testing.TB
+	failures []string
+}
+
+func (r *recorder) Fatalf(format string, args ...any) {
+	r.failures = append(r.failures, fmt.Sprintf(format, args...))
+}
+
+func TestScenarioFailsClearly(t *testing.T) {
+	r := &recorder{TB: t}
+	Given(r, STATE_PENDING).Then(STATE_APPROVED).When("Ship", "post").When("Launch")
+
+	want := []string{
+		"got Pending, want Approved",
+		"When(\"Ship\"): attempted to invoke event Ship from invalid state: 2",
+		"When(\"Launch\"): unknown event \"Launch\"",
+	}
+	if fmt.Sprint(r.failures) != fmt.Sprint(want) {
+		t.Fatal(r.failures)
+	}
+}
+`,
+	})
+	if err != nil {
+		t.Fatalf("%v\n%v", err, output)
+	}
+}
+
+// What stringer -type=State prints for the STATE_OFF and STATE_ON
+// constants, less its header.
+const _STRINGER_OUTPUT = `func _() {
+	// An "invalid array index" compiler error signifies that the constant values have changed.
+	// Re-run the stringer command to generate them again.
+	var x [1]struct{}
+	_ = x[STATE_OFF-0]
+	_ = x[STATE_ON-1]
+}
+
+const _State_name = "STATE_OFFSTATE_ON"
+
+var _State_index = [...]uint8{0, 9, 17}
+
+func (i State) String() string {
+	if i >= State(len(_State_index)-1) {
+		return "State(" + strconv.FormatInt(int64(i), 10) + ")"
+	}
+	return _State_name[_State_index[i]:_State_index[i+1]]
+}
+`
+
+func TestStringerCompatible(t *testing.T) {
+	definition := _Parse(t, `
+Name = "Light"
+PackageName = "lights"
+
+[Events.SwitchOn]
+Source = ["Off"]
+Destination = "On"
+`)
+	definition.StringerCompatible = true
+	code := _Compiles(t, definition)
+	if !strings.Contains(code, _STRINGER_OUTPUT) {
+		t.Fatal(code)
+	}
+
+	_RunScenario(t, definition, `package lights
+
+import "testing"
+
+func TestString(t *testing.T) {
+	if STATE_ON.String() != "STATE_ON" || State(7).String() != "State(7)" {
+		t.Fatal(STATE_ON.String(), State(7).String())
+	}
+}
+`)
+}
+
+func TestDispatcher(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML)
+	definition.Dispatcher = true
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package orders
+
+import "testing"
+
+func TestFire(t *testing.T) {
+	fsm := NewFSM(STATE_PENDING)
+	fsm.SetApproveHook(func() {})
+	var carrier string
+	fsm.SetShipHook(func(c string) { carrier = c })
+
+	if err := fsm.Fire("APPROVE"); err != nil || fsm.State != STATE_APPROVED {
+		t.Fatal(err, fsm.State)
+	}
+	if err := fsm.Fire("ship", 42); err == nil || err.Error() != "event Ship param carrier must be string, got int" {
+		t.Fatal(err)
+	}
+	if err := fsm.Fire("Ship", "post"); err != nil || fsm.State != STATE_SHIPPED || carrier != "post" {
+		t.Fatal(err, fsm.State, carrier)
+	}
+}
+`)
+
+	definition = _Parse(t, _ORDER_TOML+`
+[Events.ship]
+Source = ["Pending"]
+Destination = "Shipped"
+`)
+	definition.Dispatcher = true
+	err := ValidateDefinition(definition)
+	if err == nil || err.Error() != `events Ship and ship both dispatch as "ship" in Fire` {
+		t.Fatal(err)
+	}
+}
+
+func TestFields(t *testing.T) {
+	definition := _Parse(t, `Fields = [
+	{ Name = "Tenant", Type = "string" },
+	{ Name = "Timeout", Type = "time.Duration", Import = "time" },
+]`+_ORDER_TOML)
+	code := _Compiles(t, definition)
+	if !strings.Contains(code, `"time"`) {
+		t.Fatal("the field's import should be added", code)
+	}
+
+	_RunScenario(t, definition, `package orders
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFieldsFromNewFSM(t *testing.T) {
+	fsm := NewFSM(STATE_PENDING, "acme", time.Second)
+	if fsm.Tenant != "acme" || fsm.Timeout != time.Second {
+		t.Fatal(fsm.Tenant, fsm.Timeout)
+	}
+}
+`)
+
+	for _, test := range []struct {
+		fields string
+		want   string
+	}{
+		{`{ Name = "State", Type = "string" }`, "field name State collides with a generated member of JobFSM"},
+		{`{ Name = "_Hooks", Type = "string" }`, "field name _Hooks collides with a generated member of JobFSM"},
+		{`{ Name = "Visits", Type = "int" }`, "field name Visits collides with a generated member of JobFSM"},
+		{`{ Name = "Tenant", Type = "string" }, { Name = "Tenant", Type = "int" }`, "field Tenant is declared more than once"},
+		{`{ Name = "tenant id", Type = "string" }`, `field name "tenant id" is not a valid Go identifier`},
+		{`{ Name = "Tenant", Type = "map[string" }`, `field Tenant has invalid type "map[string": 1:11: expected ']', found newline`},
+	} {
+		definition := _Parse(t, "Fields = ["+test.fields+"]"+_RETRY_TOML)
+		if err := ValidateDefinition(definition); err == nil || err.Error() != test.want {
+			t.Fatal(test.fields, err)
+		}
+	}
+}
+
+func TestReachableFinalStates(t *testing.T) {
+	definition := _Parse(t, `FinalStates = ["Shipped", "Cancelled"]`+_ORDER_TOML)
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package orders
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestNarrowsAsTheMachineAdvances(t *testing.T) {
+	fsm := NewFSM(STATE_PENDING)
+	fsm.SetApproveHook(func() {})
+	fsm.SetShipHook(func(string) {})
+
+	both := []State{STATE_CANCELLED, STATE_SHIPPED}
+	if got := fsm.ReachableFinalStates(); !slices.Equal(got, both) {
+		t.Fatal(got)
+	}
+	fsm.Approve()
+	if got := fsm.ReachableFinalStates(); !slices.Equal(got, both) {
+		t.Fatal(got)
+	}
+	fsm.Ship("post")
+	if got := fsm.ReachableFinalStates(); !slices.Equal(got, []State{STATE_SHIPPED}) {
+		t.Fatal(got)
+	}
+
+	got := fsm.ReachableFinalStates()
+	got[0] = STATE_PENDING
+	if fsm.ReachableFinalStates()[0] != STATE_SHIPPED {
+		t.Fatal("callers should not be able to modify the table")
+	}
+}
+`)
+}
+
+func TestUnknownEvent(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML)
+	definition.Dispatcher = true
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package orders
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestUnknownEventErrors(t *testing.T) {
+	err := NewFSM(STATE_PENDING).Fire("launch")
+	if !errors.Is(err, ErrUnknownEvent) || err.Error() != "unknown event: \"launch\"" {
+		t.Fatal(err)
+	}
+}
+`)
+
+	definition.UnknownEvent = "ignore"
+	code := _Compiles(t, definition)
+	if strings.Contains(code, "ErrUnknownEvent") {
+		t.Fatal("ErrUnknownEvent is only needed by the error policy")
+	}
+	_RunScenario(t, definition, `package orders
+
+import "testing"
+
+func TestUnknownEventIgnored(t *testing.T) {
+	fsm := NewFSM(STATE_PENDING)
+	if err := fsm.Fire("launch"); err != nil || fsm.State != STATE_PENDING {
+		t.Fatal(err, fsm.State)
+	}
+}
+`)
+
+	definition.UnknownEvent = "log"
+	_Compiles(t, definition)
+	_RunScenario(t, definition, `package orders
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestUnknownEventLogged(t *testing.T) {
+	buffer := bytes.Buffer{}
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buffer, nil)))
+
+	if err := NewFSM(STATE_PENDING).Fire("launch"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buffer.String(), "level=WARN msg=\"Ignoring unknown event\" Event=launch") {
+		t.Fatal(buffer.String())
+	}
+}
+`)
+
+	definition.UnknownEvent = "panic"
+	err := ValidateDefinition(definition)
+	if err == nil || err.Error() != "unknown UnknownEvent panic, expected error, ignore or log" {
+		t.Fatal(err)
+	}
+}
+
+func TestStateNameLookupCompleteTest(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML)
+	definition.EmitTests = true
+	testCode, err := format.Source([]byte(BuildTestText(definition)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := _Build(t, definition)
+
+	if output, err := _GoTest(t, map[string]string{
+		"fsm_GEN.go":      code,
+		"fsm_GEN_test.go": string(testCode),
+	}); err != nil {
+		t.Fatalf("%v\n%v", err, output)
+	}
+
+	missing := regexp.MustCompile(`\t3: +"Shipped", +// STATE_SHIPPED\n`)
+	if !missing.MatchString(code) {
+		t.Fatal(code)
+	}
+	output, err := _GoTest(t, map[string]string{
+		"fsm_GEN.go":      missing.ReplaceAllString(code, ""),
+		"fsm_GEN_test.go": string(testCode),
+	})
+	if err == nil || !strings.Contains(output, "FSM_STATE_NAME_LOOKUP has 3 entries, want 4") ||
+		!strings.Contains(output, "state 3 is missing from FSM_STATE_NAME_LOOKUP") {
+		t.Fatal("the emitted test should catch a missing entry", err, output)
+	}
+}
+
+func TestEventMethodDoc(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML)
+	definition.Events["Cancel"] = FSMEventDefinition{
+		Source:      []string{"Pending", "Approved"},
+		Destination: "Cancelled",
+	}
+	code := _Compiles(t, definition)
+	if !strings.Contains(code, "\n// Cancel is valid from: Approved, Pending. Transitions to: Cancelled.\n") {
+		t.Fatal("sources should be sorted", code)
+	}
+}
+
+func TestCode(t *testing.T) {
+	definition := _Parse(t, `Fields = [{ Name = "Log", Type = "[]string" }]`+_ORDER_TOML)
+	ship := definition.Events["Ship"]
+	ship.Code = `fsm.Log = append(fsm.Log, carrier+" "+FSM_STATE_NAME_LOOKUP[fsm.State])`
+	definition.Events["Ship"] = ship
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package orders
+
+import "testing"
+
+func TestInjectedCodeRuns(t *testing.T) {
+	fsm := NewFSM(STATE_APPROVED, nil)
+	fsm.SetShipHook(func(string) {})
+	if err := fsm.Ship("post"); err != nil {
+		t.Fatal(err)
+	}
+	if len(fsm.Log) != 1 || fsm.Log[0] != "post Shipped" {
+		t.Fatal(fsm.Log)
+	}
+}
+`)
+
+	for code, want := range map[string]string{
+		"fsm.Log = append(":                       "event Ship: Code does not parse as Go statements: Ship:4:1: expected operand, found '}'",
+		"}\nfunc init() { panic(1) }\nfunc _() {": "event Ship: Code must only contain statements, not declarations",
+		"}\nvar Injected = 1\nfunc _() {":         "event Ship: Code must only contain statements, not declarations",
+	} {
+		ship.Code = code
+		definition.Events["Ship"] = ship
+		if err := ValidateDefinition(definition); err == nil || err.Error() != want {
+			t.Fatal(code, err)
+		}
+	}
+}
+
+func TestPathEvents(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML+`
+[Events.Adjourn]
+Source = ["Pending"]
+Destination = "OnHold"
+
+[Events.Release]
+Source = ["OnHold"]
+Destination = "Approved"
+`)
+	// Adjourn is tried before Approve, so only a breadth-first search finds
+	// the shorter path through Approve.
+	definition.PathEvents = true
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package orders
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestShortestPath(t *testing.T) {
+	for range 2 {
+		path, ok := PathEvents(STATE_PENDING, STATE_SHIPPED)
+		if !ok || !slices.Equal(path, []string{"Approve", "Ship"}) {
+			t.Fatal(path, ok)
+		}
+		path[0] = "Adjourn"
+	}
+
+	if path, ok := PathEvents(STATE_ONHOLD, STATE_SHIPPED); !ok || !slices.Equal(path, []string{"Release", "Ship"}) {
+		t.Fatal(path, ok)
+	}
+	if path, ok := PathEvents(STATE_PENDING, STATE_PENDING); !ok || len(path) != 0 {
+		t.Fatal(path, ok)
+	}
+	if path, ok := PathEvents(STATE_SHIPPED, STATE_PENDING); ok || path != nil {
+		t.Fatal(path, ok)
+	}
+}
+`)
+}
+
+func TestMapParams(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML+`
+[[Events.Ship.Params]]
+Name = "parcels"
+Type = "int"
+`)
+	definition.MapParams = true
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package orders
+
+import "testing"
+
+func TestMapParams(t *testing.T) {
+	fsm := NewFSM(STATE_APPROVED)
+	var carrier string
+	var parcels int
+	fsm.SetShipHook(func(c string, p int) { carrier, parcels = c, p })
+
+	for _, test := range []struct {
+		m    map[string]any
+		want string
+	}{
+		{map[string]any{"parcels": 2}, "event Ship: missing param carrier"},
+		{map[string]any{"carrier": "post", "parcels": 2.0}, "event Ship: param parcels must be int, got float64"},
+	} {
+		if err := fsm.ShipMap(test.m); err == nil || err.Error() != test.want {
+			t.Fatal(err)
+		}
+	}
+	if fsm.State != STATE_APPROVED {
+		t.Fatal(fsm.State)
+	}
+
+	if err := fsm.ShipMap(map[string]any{"carrier": "post", "parcels": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if fsm.State != STATE_SHIPPED || carrier != "post" || parcels != 2 {
+		t.Fatal(fsm.State, carrier, parcels)
+	}
+
+	pending := NewFSM(STATE_PENDING)
+	pending.SetApproveHook(func() {})
+	if err := pending.ApproveMap(nil); err != nil || pending.State != STATE_APPROVED {
+		t.Fatal(err, pending.State)
+	}
+}
+`)
+}
+
+const _REGIONS_TOML = `
+Name = "Conn"
+PackageName = "conns"
+InitialState = "Open"
+
+[Regions.auth]
+InitialState = "Anonymous"
+
+[Regions.activity]
+InitialState = "Idle"
+
+[Events.Close]
+Source = ["Open"]
+Destination = "Closed"
+
+[Events.Login]
+Region = "auth"
+Source = ["Anonymous"]
+Destination = "Authenticated"
+
+[Events.Logout]
+Region = "auth"
+Source = ["Authenticated"]
+Destination = "Anonymous"
+
+[Events.Start]
+Region = "activity"
+Source = ["Idle"]
+Destination = "Busy"
+
+[Events.Finish]
+Region = "activity"
+Source = ["Busy"]
+Destination = "Idle"
+`
+
+func TestRegions(t *testing.T) {
+	definition := _Parse(t, _REGIONS_TOML)
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package conns
+
+import "testing"
+
+func TestRegionsDontInterfere(t *testing.T) {
+	fsm := NewFSM(STATE_OPEN)
+	fsm.SetCloseHook(func() {})
+	fsm.SetLoginHook(func() {})
+	fsm.SetLogoutHook(func() {})
+	fsm.SetStartHook(func() {})
+	fsm.SetFinishHook(func() {})
+	if fsm.AuthState != STATE_ANONYMOUS || fsm.ActivityState != STATE_IDLE {
+		t.Fatal(fsm.AuthState, fsm.ActivityState)
+	}
+
+	if err := fsm.Login(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsm.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if fsm.State != STATE_OPEN || fsm.AuthState != STATE_AUTHENTICATED || fsm.ActivityState != STATE_BUSY {
+		t.Fatal(fsm.State, fsm.AuthState, fsm.ActivityState)
+	}
+
+	if err := fsm.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fsm.State != STATE_CLOSED || fsm.AuthState != STATE_AUTHENTICATED || fsm.ActivityState != STATE_IDLE {
+		t.Fatal(fsm.State, fsm.AuthState, fsm.ActivityState)
+	}
+
+	err := fsm.Finish()
+	if err == nil || err.Error() != "attempted to invoke event Finish from invalid state: 4" {
+		t.Fatal("Finish should check the activity region", err)
+	}
+}
+`)
+
+	definition.EventStream = true
+	definition.DoneCallback = true
+	definition.CanTransition = true
+	definition.ApplyAll = true
+	definition.ApplyAllRollback = true
+	code := _Compiles(t, definition)
+	for _, want := range []string{
+		"switch fsm.ActivityState {",
+		"from := fsm.AuthState",
+		"done(fsm.AuthState, err)",
+		"fsm.CanTransition(fsm.ActivityState, STATE_IDLE, \"Finish\")",
+		"startAuthState := fsm.AuthState",
+	} {
+		if !strings.Contains(code, want) {
+			t.Fatal(want, code)
+		}
+	}
+}
+
+func TestRegionsValidation(t *testing.T) {
+	for _, test := range []struct {
+		toml string
+		want string
+	}{
+		{`
+[Events.Kick]
+Region = "auth"
+Source = ["Idle"]
+Destination = "Anonymous"
+`, "event Kick uses state Idle of region activity in region auth"},
+		{`
+[Events.Kick]
+Region = "auth"
+Source = ["Authenticated"]
+Destination = "Closed"
+`, "event Kick uses state Closed of the main machine in region auth"},
+		{`
+[Events.Kick]
+Region = "session"
+Source = ["Authenticated"]
+Destination = "Anonymous"
+`, "event Kick: Region session is not declared in Regions"},
+		{`
+[Regions.billing]
+InitialState = "Busy"
+`, "Regions.billing InitialState Busy is not used by any of its events"},
+		{`
+[Regions.billing]
+`, "Regions.billing needs an InitialState"},
+	} {
+		definition := _Parse(t, _REGIONS_TOML+test.toml)
+		if err := ValidateDefinition(definition); err == nil || err.Error() != test.want {
+			t.Fatal(test.toml, err)
+		}
+	}
+
+	definition := _Parse(t, _REGIONS_TOML)
+	definition.InitialState = "Idle"
+	if err := ValidateDefinition(definition); err == nil || err.Error() != "InitialState Idle belongs to region activity" {
+		t.Fatal(err)
+	}
+
+	definition = _Parse(t, _REGIONS_TOML)
+	definition.JSON = true
+	err := ValidateDefinition(definition)
+	if err == nil || err.Error() != "JSON only knows the main machine's State and can't be used with Regions" {
+		t.Fatal(err)
+	}
+
+	definition.JSON = false
+	definition.StateInfo = true
+	err = ValidateDefinition(definition)
+	if err == nil || err.Error() != "StateInfo only knows the main machine's State and can't be used with Regions" {
+		t.Fatal(err)
+	}
+
+	if warnings, _ := CheckNoReturn(_Parse(t, _REGIONS_TOML)); !slices.Equal(_Messages(warnings), []string{"state Closed has no path back to Open"}) {
+		t.Fatal("region states should be checked against their own InitialState", _Messages(warnings))
+	}
+}
+
+func TestResetRegion(t *testing.T) {
+	definition := _Parse(t, _REGIONS_TOML)
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package conns
+
+import "testing"
+
+func TestResetLeavesOtherRegionsAlone(t *testing.T) {
+	fsm := NewFSM(STATE_OPEN)
+	fsm.SetCloseHook(func() {})
+	fsm.SetLoginHook(func() {})
+	fsm.SetStartHook(func() {})
+	fsm.Login()
+	fsm.Start()
+	fsm.Close()
+
+	fsm.ResetRegionAuth()
+	if fsm.AuthState != STATE_ANONYMOUS {
+		t.Fatal(fsm.AuthState)
+	}
+	if fsm.State != STATE_CLOSED || fsm.ActivityState != STATE_BUSY {
+		t.Fatal(fsm.State, fsm.ActivityState)
+	}
+	if err := fsm.Login(); err != nil {
+		t.Fatal(err)
+	}
+}
+`)
+
+	definition = _Parse(t, _REGIONS_TOML+`
+[Events.ResetRegionAuth]
+Source = ["Open"]
+Destination = "Open"
+`)
+	err := ValidateDefinition(definition)
+	if err == nil || err.Error() != "event ResetRegionAuth collides with a generated member of ConnFSM, consider renaming it to ResetRegionAuthEvent" {
+		t.Fatal(err)
+	}
+}
+
+func TestRegionHelpers(t *testing.T) {
+	definition := _Parse(t, `FinalStates = ["Closed", "Busy"]`+"\n"+_REGIONS_TOML)
+	definition.ExpectState = true
+	if warnings := CheckFinalStatesReachable(definition); len(warnings) != 0 {
+		t.Fatal(warnings)
+	}
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package conns
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestHelpersCheckTheOwningRegion(t *testing.T) {
+	fsm := NewFSM(STATE_OPEN)
+	fsm.SetLoginHook(func() {})
+	fsm.SetStartHook(func() {})
+
+	if finals := fsm.ReachableFinalStates(); !slices.Equal(finals, []State{STATE_CLOSED, STATE_BUSY}) {
+		t.Fatal("final states of regions should be reported", finals)
+	}
+	fsm.Start()
+	if finals := fsm.ReachableFinalStates(); !slices.Equal(finals, []State{STATE_CLOSED, STATE_BUSY}) {
+		t.Fatal(finals)
+	}
+
+	if err := fsm.ExpectState(STATE_ANONYMOUS); err != nil {
+		t.Fatal(err)
+	}
+	fsm.Login()
+	if err := fsm.ExpectState(STATE_ANONYMOUS); err == nil || err.Error() != "got Authenticated, want Anonymous" {
+		t.Fatal(err)
+	}
+	for _, want := range []State{STATE_OPEN, STATE_AUTHENTICATED, STATE_BUSY} {
+		if err := fsm.ExpectState(want); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+`)
+
+	definition.EmitTests = true
+	testCode, err := format.Source([]byte(BuildTestText(definition)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := _GoTest(t, map[string]string{
+		"fsm_GEN.go":      _Build(t, definition),
+		"fsm_GEN_test.go": string(testCode),
+		"scenario_test.go": `package conns
+
+import (
+	"fmt"
+	"testing"
+)
+
+type recorder struct {
+	testing.TB
+	failures []string
+}
+
+func (r *recorder) Fatalf(format string, args ...any) {
+	r.failures = append(r.failures, fmt.Sprintf(format, args...))
+}
+
+func TestThenChecksTheOwningRegion(t *testing.T) {
+	Given(t, STATE_OPEN).When("Login").Then(STATE_AUTHENTICATED).Then(STATE_OPEN).Then(STATE_IDLE)
+
+	r := &recorder{TB: t}
+	Given(r, STATE_OPEN).Then(STATE_BUSY).When("Close").Then(STATE_ANONYMOUS)
+	if want := []string{"got Idle, want Busy"}; fmt.Sprint(r.failures) != fmt.Sprint(want) {
+		t.Fatal(r.failures)
+	}
+}
+`,
+	})
+	if err != nil {
+		t.Fatalf("%v\n%v", err, output)
+	}
+}
+
+func TestSQL(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML)
+	definition.SQL = true
+	_Compiles(t, definition)
+
+	scenario := `package orders
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"testing"
+)
+
+var (
+	_ sql.Scanner   = (*State)(nil)
+	_ driver.Valuer = State(0)
+)
+
+func TestRoundTrip(t *testing.T) {
+	value, err := STATE_SHIPPED.Value()
+	if err != nil || value != "Shipped" {
+		t.Fatal(value, err)
+	}
+	var state State
+	for _, src := range []any{"Shipped", []byte("Shipped")} {
+		state = STATE_PENDING
+		if err := state.Scan(src); err != nil || state != STATE_SHIPPED {
+			t.Fatal(src, state, err)
+		}
+	}
+	if _, err := State(99).Value(); err == nil || err.Error() != "cannot store invalid state 99" {
+		t.Fatal(err)
+	}
+}
+
+func TestScanErrors(t *testing.T) {
+	var state State
+	for src, want := range map[any]string{
+		"Lost": "unknown state \"Lost\"",
+		42:     "cannot scan int into State",
+	} {
+		if err := state.Scan(src); err == nil || err.Error() != want {
+			t.Fatal(src, err)
+		}
+	}
+}
+
+func TestScanNull(t *testing.T) {
+	state := STATE_SHIPPED
+	err := state.Scan(nil)
+	WANT_NULL
+}
+`
+	_RunScenario(t, definition, strings.ReplaceAll(scenario, "WANT_NULL", `if err == nil || err.Error() != "cannot scan NULL into State" {
+		t.Fatal(err)
+	}`))
+
+	definition.UnspecifiedState = "Unknown"
+	_RunScenario(t, definition, strings.ReplaceAll(scenario, "WANT_NULL", `if err != nil || state != STATE_UNKNOWN {
+		t.Fatal(state, err)
+	}`))
+}
+
+func TestStateInfo(t *testing.T) {
+	definition := _Parse(t, `FinalStates = ["Shipped"]`+_ORDER_TOML+`
+[States.Shipped]
+Display = "On its way"
+Doc = "Handed to the carrier."
+Tags = ["done", "billable"]
+`)
+	definition.StateInfo = true
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package orders
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStateInfo(t *testing.T) {
+	fsm := NewFSM(STATE_PENDING)
+	if got := fsm.StateInfo(); !reflect.DeepEqual(got, StateInfo{Name: "Pending", Display: "Pending"}) {
+		t.Fatalf("%#v", got)
+	}
+
+	fsm = NewFSM(STATE_SHIPPED)
+	want := StateInfo{"Shipped", "On its way", "Handed to the carrier.", []string{"done", "billable"}, true}
+	got := fsm.StateInfo()
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("%#v", got)
+	}
+	got.Tags[0] = "changed"
+	if fsm.StateInfo().Tags[0] != "done" {
+		t.Fatal("callers should not be able to modify the table")
+	}
+}
+`)
+}
+
+func TestCanTransition(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML)
+	definition.CanTransition = true
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package orders
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestVeto(t *testing.T) {
+	fsm := NewFSM(STATE_PENDING)
+	approved := false
+	fsm.SetApproveHook(func() { approved = true })
+	fsm.SetCancelHook(func() {})
+
+	if err := fsm.Approve(); err != nil {
+		t.Fatal("a nil CanTransition should allow everything", err)
+	}
+
+	fsm = NewFSM(STATE_PENDING)
+	fsm.SetApproveHook(func() { approved = true })
+	fsm.SetCancelHook(func() {})
+	var calls []string
+	fsm.CanTransition = func(from, to State, event string) (bool, error) {
+		calls = append(calls, FSM_STATE_NAME_LOOKUP[from]+" "+event+" "+FSM_STATE_NAME_LOOKUP[to])
+		return false, nil
+	}
+	approved = false
+	for _, fire := range []func() error{fsm.Approve, fsm.Cancel} {
+		if err := fire(); !errors.Is(err, ErrTransitionVetoed) {
+			t.Fatal(err)
+		}
+	}
+	if approved || fsm.State != STATE_PENDING {
+		t.Fatal("a vetoed event should not run its hook or move", approved, fsm.State)
+	}
+	if len(calls) != 2 || calls[0] != "Pending Approve Approved" || calls[1] != "Pending Cancel Cancelled" {
+		t.Fatal(calls)
+	}
+
+	boom := errors.New("boom")
+	fsm.CanTransition = func(State, State, string) (bool, error) { return true, boom }
+	if err := fsm.Approve(); err != boom {
+		t.Fatal(err)
+	}
+}
+`)
+
+	definition = _Parse(t, _ORDER_TOML+`
+[Groups.decision]
+`)
+	_SetGroup(definition, "decision", "Approve", "Cancel")
+	definition.CanTransition = true
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package orders
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLockedGroupSkipsVeto(t *testing.T) {
+	fsm := NewFSM(STATE_PENDING)
+	fsm.SetApproveHook(func() {})
+	fsm.SetCancelHook(func() {})
+	var calls []string
+	fsm.CanTransition = func(from, to State, event string) (bool, error) {
+		calls = append(calls, event)
+		return true, nil
+	}
+
+	if err := fsm.Approve(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsm.Cancel(); !errors.Is(err, ErrGroupLocked) {
+		t.Fatal(err)
+	}
+	if len(calls) != 1 || calls[0] != "Approve" {
+		t.Fatal("CanTransition should not be asked about a locked event", calls)
+	}
+}
+`)
+}
+
+func TestEventString(t *testing.T) {
+	definition := _Parse(t, `Order = ["Ship", "cancel", "Approve"]`+strings.Replace(_ORDER_TOML, "[Events.Cancel]", "[Events.cancel]", 1))
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package orders
+
+import "testing"
+
+func TestEventString(t *testing.T) {
+	for event, want := range map[Event]string{
+		EVENT_SHIP:    "Ship",
+		EVENT_CANCEL:  "cancel",
+		EVENT_APPROVE: "Approve",
+		Event(3):      "Event(3)",
+		Event(200):    "Event(200)",
+	} {
+		if got := event.String(); got != want {
+			t.Fatal(got, want)
+		}
+	}
+}
+`)
+}
+
+func TestAllEvents(t *testing.T) {
+	definition := _Parse(t, `Order = ["Ship", "Cancel", "Approve"]`+_ORDER_TOML)
+	approve := definition.Events["Approve"]
+	approve.Doc = "Accepts the order."
+	definition.Events["Approve"] = approve
+	definition.AllEvents = true
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package orders
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAllEvents(t *testing.T) {
+	want := []EventInfo{
+		{Name: "Approve", Sources: []string{"Pending"}, Destination: "Approved", Params: []EventParam{}, Doc: "Accepts the order."},
+		{Name: "Cancel", Sources: []string{"Pending", "Approved"}, Destination: "Cancelled", Params: []EventParam{}},
+		{Name: "Ship", Sources: []string{"Approved"}, Destination: "Shipped", Params: []EventParam{{Name: "carrier", Type: "string"}}},
+	}
+	if got := AllEvents(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("%#v", got)
+	}
+}
+`)
+}
+
+func TestPayloads(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML)
+	definition.Payloads = true
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package orders
+
+import "testing"
+
+type otherPayload struct{ EventPayload }
+
+func TestHandle(t *testing.T) {
+	fsm := NewFSM(STATE_PENDING)
+	fsm.SetApproveHook(func() {})
+	var carrier string
+	fsm.SetShipHook(func(c string) { carrier = c })
+
+	queue := make(chan EventPayload, 2)
+	queue <- ApprovePayload{}
+	queue <- ShipPayload{Carrier: "post"}
+	close(queue)
+
+	want := []State{STATE_APPROVED, STATE_SHIPPED}
+	i := 0
+	for e := range queue {
+		if err := fsm.Handle(e); err != nil || fsm.State != want[i] {
+			t.Fatal(e, err, fsm.State)
+		}
+		i++
+	}
+	if carrier != "post" {
+		t.Fatal(carrier)
+	}
+
+	if err := fsm.Handle(CancelPayload{}); err == nil {
+		t.Fatal("Handle should return the event's own error")
+	}
+	if err := fsm.Handle(otherPayload{}); err == nil || err.Error() != "unknown event payload orders.otherPayload" {
+		t.Fatal(err)
+	}
+}
+`)
+
+	definition = _Parse(t, _ORDER_TOML+`
+[Events.event]
+Source = ["Pending"]
+Destination = "Pending"
+`)
+	if err := ValidateDefinition(definition); err != nil {
+		t.Fatal("an event named event only collides with Payloads", err)
+	}
+	definition.Payloads = true
+	err := ValidateDefinition(definition)
+	if err == nil || err.Error() != "event event: payload struct EventPayload collides with the EventPayload interface, rename the event" {
+		t.Fatal(err)
+	}
+
+	definition = _Parse(t, _ORDER_TOML)
+	definition.Payloads = true
+	ship := definition.Events["Ship"]
+	ship.Params = append(ship.Params, FSMEventParams{Name: "Carrier", Type: "string"})
+	definition.Events["Ship"] = ship
+	err = ValidateDefinition(definition)
+	if err == nil || err.Error() != "event Ship: params carrier and Carrier both become the payload field Carrier" {
+		t.Fatal(err)
+	}
+}
+
+func TestParamShadowing(t *testing.T) {
+	for _, test := range []struct {
+		param        string
+		doneCallback bool
+		want         string
+	}{
+		{"fsm", false, "event Ship: param fsm would shadow the receiver, rename it"},
+		{"hook", false, "event Ship: param hook would shadow the hook being called, rename it"},
+		{"len", false, "event Ship: param len would shadow the Go builtin len, rename it"},
+		{"cap", false, "event Ship: param cap would shadow the Go builtin cap, rename it"},
+		{"done", true, "event Ship: param done would shadow the done callback, rename it"},
+		{"done", false, ""},
+	} {
+		definition := _Parse(t, _ORDER_TOML+`
+[[Events.Ship.Params]]
+Name = "`+test.param+`"
+Type = "int"
+`)
+		definition.DoneCallback = test.doneCallback
+		err := ValidateDefinition(definition)
+		if test.want == "" {
+			if err != nil {
+				t.Fatal(test.param, err)
+			}
+			_Compiles(t, definition)
+		} else if err == nil || err.Error() != test.want {
+			t.Fatal(test.param, err)
+		}
+	}
+}
+
+func TestPostCmd(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "fsm.toml"), []byte(_ORDER_TOML), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if output, err := _RunMain(t, dir, "-post-cmd", "cp {{.Path}} {{.Package}}_copy.go"); err != nil {
+		t.Fatal(err, output)
+	}
+	generated, err := os.ReadFile(filepath.Join(dir, "fsm_GEN.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, err := os.ReadFile(filepath.Join(dir, "orders_copy.go"))
+	if err != nil || string(copied) != string(generated) {
+		t.Fatal("post-cmd should run on the written file", err)
+	}
+
+	output, err := _RunMain(t, dir, "-post-cmd", "cat missing.txt")
+	if err == nil {
+		t.Fatal("a failing post-cmd should fail generation", output)
+	}
+	if !strings.Contains(output, "post-cmd cat missing.txt failed") || !strings.Contains(output, "missing.txt: No such file or directory") {
+		t.Fatal("the command's stderr should be surfaced", output)
+	}
+
+	definition := _Parse(t, _ORDER_TOML)
+	for text, want := range map[string]string{
+		"   ":                `post-cmd "   " has no command`,
+		"gofmt {{.Missing}}": `template: post-cmd:1:2: executing "post-cmd" at <.Missing>: map has no entry for key "Missing"`,
+	} {
+		if err := RunPostCmd(text, definition, "fsm_GEN.go"); err == nil || err.Error() != want {
+			t.Fatal(text, err)
+		}
+	}
+}
+
+func TestGoTo(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML+`
+[Events.Reject]
+Source = ["Pending"]
+Destination = "Cancelled"
+`)
+	definition.GoTo = true
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package orders
+
+import "testing"
+
+func TestGoTo(t *testing.T) {
+	fsm := NewFSM(STATE_PENDING)
+	fsm.SetApproveHook(func() {})
+	fsm.SetCancelHook(func() {})
+	fsm.SetRejectHook(func() {})
+
+	for stateName, want := range map[string]string{
+		"Shipped":   "no event leads from Pending to Shipped",
+		"Cancelled": "ambiguous: events Cancel, Reject all lead from Pending to Cancelled",
+		"Lost":      "unknown state \"Lost\"",
+	} {
+		if err := fsm.GoTo(stateName); err == nil || err.Error() != want {
+			t.Fatal(stateName, err)
+		}
+		if fsm.State != STATE_PENDING {
+			t.Fatal(stateName, fsm.State)
+		}
+	}
+
+	if err := fsm.GoTo("Approved"); err != nil || fsm.State != STATE_APPROVED {
+		t.Fatal(err, fsm.State)
+	}
+	if err := fsm.GoTo("Shipped"); err == nil || err.Error() != "event Ship leads from Approved to Shipped but takes params" {
+		t.Fatal(err)
+	}
+	if err := fsm.GoTo("Cancelled"); err != nil || fsm.State != STATE_CANCELLED {
+		t.Fatal("only Cancel leads from Approved to Cancelled", err, fsm.State)
+	}
+}
+`)
+}
+
+func TestStringTable(t *testing.T) {
+	definition := _Parse(t, strings.Replace(_ORDER_TOML, "[Events.Cancel]", "[Events.cancel]", 1))
+	definition.StringTable = true
+	_Compiles(t, definition)
+
+	_RunScenario(t, definition, `package orders
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStringTable(t *testing.T) {
+	want := map[string]map[string]string{
+		"Pending":   {"Approve": "Approved", "cancel": "Cancelled"},
+		"Approved":  {"Ship": "Shipped", "cancel": "Cancelled"},
+		"Cancelled": {},
+		"Shipped":   {},
+	}
+	if !reflect.DeepEqual(StringTable, want) {
+		t.Fatal(StringTable)
+	}
+}
+`)
+}
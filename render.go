@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"go/format"
+	"slices"
+	"strings"
+)
+
+// FORMAT_EXTENSIONS lists every -format with the extension its output is
+// written with when no -dest-file is given.
+var FORMAT_EXTENSIONS = map[string]string{
+	"go":      ".go",
+	"params":  ".mmd",
+	"mermaid": ".mmd",
+	"csv":     ".csv",
+	"dot":     ".dot",
+}
+
+// Render produces the output for one -format. Only go runs the Go
+// generator and gofmt; the other formats render the definition directly.
+func Render(definition FSMDefinition, outputFormat string) ([]byte, error) {
+	switch outputFormat {
+	case "go":
+		return format.Source([]byte(BuildText(definition)))
+	case "params":
+		return []byte(RenderParams(definition)), nil
+	case "mermaid":
+		return []byte(RenderMermaid(definition)), nil
+	case "csv":
+		rendered, err := RenderCSV(definition)
+		return []byte(rendered), err
+	case "dot":
+		return []byte(RenderDot(definition)), nil
+	}
+	return nil, fmt.Errorf("unknown format %v", outputFormat)
+}
+
+// _Transitions calls yield with every source, event and destination, in
+// event order with each event's sources sorted.
+func _Transitions(definition FSMDefinition, yield func(src, eventName, dest string)) {
+	for _, eventName := range _GetEvents(definition) {
+		event := definition.Events[eventName]
+		sources := slices.Clone(event.Source)
+		slices.Sort(sources)
+		for _, src := range sources {
+			yield(src, eventName, event.Destination)
+		}
+	}
+}
+
+// RenderMermaid draws the machine as a Mermaid state diagram, entering at
+// InitialState and leaving from the FinalStates.
+func RenderMermaid(definition FSMDefinition) string {
+	builder := strings.Builder{}
+	builder.WriteString("stateDiagram-v2\n")
+
+	if definition.InitialState != "" {
+		fmt.Fprintf(&builder, "    [*] --> %v\n", definition.InitialState)
+	}
+
+	_Transitions(definition, func(src, eventName, dest string) {
+		fmt.Fprintf(&builder, "    %v --> %v: %v\n", src, dest, eventName)
+	})
+
+	finals := slices.Clone(definition.FinalStates)
+	slices.Sort(finals)
+	for _, state := range finals {
+		fmt.Fprintf(&builder, "    %v --> [*]\n", state)
+	}
+
+	return builder.String()
+}
+
+// RenderDot draws the machine as a Graphviz digraph, with FinalStates as
+// double circles and an arrow into InitialState.
+func RenderDot(definition FSMDefinition) string {
+	builder := strings.Builder{}
+	fmt.Fprintf(&builder, "digraph %q {\n", definition.Name)
+
+	for _, state := range _GetStates(definition) {
+		shape := "circle"
+		if slices.Contains(definition.FinalStates, state) {
+			shape = "doublecircle"
+		}
+		fmt.Fprintf(&builder, "    %q [shape=%v];\n", state, shape)
+	}
+
+	if definition.InitialState != "" {
+		builder.WriteString("    \"\" [shape=point];\n")
+		fmt.Fprintf(&builder, "    \"\" -> %q;\n", definition.InitialState)
+	}
+
+	_Transitions(definition, func(src, eventName, dest string) {
+		fmt.Fprintf(&builder, "    %q -> %q [label=%q];\n", src, dest, eventName)
+	})
+
+	builder.WriteString("}\n")
+	return builder.String()
+}
+
+// RenderParams draws each transition as a Mermaid sequence diagram message
+// between its source and destination, labelled with the params it takes.
+func RenderParams(definition FSMDefinition) string {
+	builder := strings.Builder{}
+	builder.WriteString("sequenceDiagram\n")
+
+	for _, state := range _GetStates(definition) {
+		fmt.Fprintf(&builder, "    participant %v\n", state)
+	}
+
+	for _, eventName := range _GetEvents(definition) {
+		event := definition.Events[eventName]
+
+		params := []string{}
+		for _, param := range event.Params {
+			params = append(params, param.Name+" "+param.Type)
+		}
+
+		sources := slices.Clone(event.Source)
+		slices.Sort(sources)
+
+		for _, src := range sources {
+			fmt.Fprintf(
+				&builder,
+				"    %v->>%v: %v(%v)\n",
+				src,
+				event.Destination,
+				eventName,
+				strings.Join(params, ", "),
+			)
+		}
+	}
+
+	return builder.String()
+}
+
+// RenderCSV lists every transition as a source,event,destination,params
+// row, sorted by source then event.
+func RenderCSV(definition FSMDefinition) (string, error) {
+	rows := [][]string{}
+
+	for _, eventName := range _GetEvents(definition) {
+		event := definition.Events[eventName]
+
+		params := []string{}
+		for _, param := range event.Params {
+			params = append(params, param.Name+" "+param.Type)
+		}
+
+		for _, src := range event.Source {
+			rows = append(rows, []string{src, eventName, event.Destination, strings.Join(params, "; ")})
+		}
+	}
+
+	slices.SortStableFunc(rows, func(a, b []string) int {
+		return strings.Compare(a[0], b[0])
+	})
+
+	builder := strings.Builder{}
+	w := csv.NewWriter(&builder)
+	w.Write([]string{"source", "event", "destination", "params"})
+	w.WriteAll(rows)
+	return builder.String(), w.Error()
+}
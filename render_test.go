@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestRenderParams(t *testing.T) {
+	want := `sequenceDiagram
+    participant Approved
+    participant Cancelled
+    participant Pending
+    participant Shipped
+    Pending->>Approved: Approve()
+    Approved->>Cancelled: Cancel()
+    Pending->>Cancelled: Cancel()
+    Approved->>Shipped: Ship(carrier string)
+`
+	definition := _Parse(t, _ORDER_TOML)
+	for range 5 {
+		if got := RenderParams(definition); got != want {
+			t.Fatalf("got\n%v\nwant\n%v", got, want)
+		}
+	}
+}
+
+func TestRenderCSV(t *testing.T) {
+	definition := _Parse(t, _ORDER_TOML+`
+[[Events.Cancel.Params]]
+Name = "reason"
+Type = "func(a, b string)"
+`)
+
+	got, err := RenderCSV(definition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `source,event,destination,params
+Approved,Cancel,Cancelled,"reason func(a, b string)"
+Approved,Ship,Shipped,carrier string
+Pending,Approve,Approved,
+Pending,Cancel,Cancelled,"reason func(a, b string)"
+`
+	if got != want {
+		t.Fatalf("got\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestRenderMermaid(t *testing.T) {
+	definition := _Parse(t, `FinalStates = ["Shipped", "Cancelled"]`+_ORDER_TOML)
+	want := `stateDiagram-v2
+    [*] --> Pending
+    Pending --> Approved: Approve
+    Approved --> Cancelled: Cancel
+    Pending --> Cancelled: Cancel
+    Approved --> Shipped: Ship
+    Cancelled --> [*]
+    Shipped --> [*]
+`
+	if got := RenderMermaid(definition); got != want {
+		t.Fatalf("got\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestRenderDot(t *testing.T) {
+	definition := _Parse(t, `FinalStates = ["Shipped"]`+_ORDER_TOML)
+	want := `digraph "Order" {
+    "Approved" [shape=circle];
+    "Cancelled" [shape=circle];
+    "Pending" [shape=circle];
+    "Shipped" [shape=doublecircle];
+    "" [shape=point];
+    "" -> "Pending";
+    "Pending" -> "Approved" [label="Approve"];
+    "Approved" -> "Cancelled" [label="Cancel"];
+    "Pending" -> "Cancelled" [label="Cancel"];
+    "Approved" -> "Shipped" [label="Ship"];
+}
+`
+	if got := RenderDot(definition); got != want {
+		t.Fatalf("got\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestDiagramFormatsWriteNoGo(t *testing.T) {
+	for _, test := range []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"-format", "dot", "-dest-file", "x.dot"}, []string{"fsm.toml", "x.dot"}},
+		{[]string{"-format", "mermaid"}, []string{"fsm.toml", "fsm_GEN.mmd"}},
+		{[]string{"-format", "csv", "-emit-tests"}, []string{"fsm.toml", "fsm_GEN.csv"}},
+		{[]string{"-format", "params", "-dest-template", "{{lower .Name}}.go"}, []string{"fsm.toml", "order.mmd"}},
+	} {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "fsm.toml"), []byte(_ORDER_TOML), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if output, err := _RunMain(t, dir, test.args...); err != nil {
+			t.Fatal(test.args, err, output)
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		if !slices.Equal(names, test.want) {
+			t.Fatal(test.args, names)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+// Finding is one result of validating or analysing a definition. Its JSON
+// form is the schema of -report json and should only grow new fields.
+type Finding struct {
+	// Severity is "error" or "warning".
+	Severity string `json:"severity"`
+	// Category identifies the check, e.g. "duplicate-transition".
+	Category string   `json:"category"`
+	Message  string   `json:"message"`
+	States   []string `json:"states,omitempty"`
+	Events   []string `json:"events,omitempty"`
+}
+
+func (f Finding) String() string {
+	return f.Severity + ": " + f.Message
+}
+
+type Report struct {
+	Findings []Finding `json:"findings"`
+	// HasErrors is true when any finding has error severity.
+	HasErrors bool `json:"hasErrors"`
+}
+
+// BuildReport runs validation and every analysis that applies to the
+// definition, regardless of which -warn flags are set. The analyses assume
+// a well-formed definition, so they are skipped while it has errors.
+func BuildReport(definition FSMDefinition) Report {
+	findings := CheckDefinition(definition)
+
+	if len(findings) == 0 {
+		findings = append(findings, CheckDuplicateTransitions(definition)...)
+		findings = append(findings, CheckFinalStatesReachable(definition)...)
+		if definition.InitialState != "" {
+			noReturn, _ := CheckNoReturn(definition)
+			findings = append(findings, noReturn...)
+		}
+	}
+
+	report := Report{Findings: findings}
+	for _, finding := range findings {
+		report.HasErrors = report.HasErrors || finding.Severity == "error"
+	}
+	return report
+}
+
+func RenderReportJSON(report Report) ([]byte, error) {
+	return json.MarshalIndent(report, "", "  ")
+}
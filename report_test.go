@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const _DUPLICATE_TOML = _ORDER_TOML + `
+[Events.Reject]
+Source = ["Approved", "Pending"]
+Destination = "Cancelled"
+`
+
+func TestBuildReport(t *testing.T) {
+	report := BuildReport(_Parse(t, _DUPLICATE_TOML))
+	if report.HasErrors || len(report.Findings) != 4 {
+		t.Fatal("expected a duplicate and three no-return warnings", report)
+	}
+
+	output, err := RenderReportJSON(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := struct {
+		Findings []map[string]any
+	}{}
+	if err := json.Unmarshal(output, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	finding := decoded.Findings[0]
+	if finding["severity"] != "warning" || finding["category"] != "duplicate-transition" {
+		t.Fatal(string(output))
+	}
+	if events, _ := json.Marshal(finding["events"]); string(events) != `["Cancel","Reject"]` {
+		t.Fatal(string(output))
+	}
+
+	definition := _Parse(t, _DUPLICATE_TOML)
+	definition.UnknownEvent = "panic"
+	definition.EventStreamPolicy = "drop-newest"
+	definition.InitialState = "Nowhere"
+	ship := definition.Events["Ship"]
+	ship.Params = []FSMEventParams{{Name: "len", Type: "int"}}
+	definition.Events["Ship"] = ship
+	report = BuildReport(definition)
+	if !report.HasErrors {
+		t.Fatal(report)
+	}
+
+	want := []Finding{
+		{"error", "unknown-event-policy", "unknown UnknownEvent panic, expected error, ignore or log", nil, nil},
+		{"error", "undeclared-initial-state", "InitialState Nowhere is not used by any event", []string{"Nowhere"}, nil},
+		{"error", "event-stream-policy", "unknown EventStreamPolicy drop-newest, expected block or drop-oldest", nil, nil},
+		{"error", "param-shadowing", "event Ship: param len would shadow the Go builtin len, rename it", nil, []string{"Ship"}},
+	}
+	if !reflect.DeepEqual(report.Findings, want) {
+		t.Fatalf("every error and no analysis warnings should be reported, got %v", report.Findings)
+	}
+	if err := ValidateDefinition(definition); err == nil || err.Error() != want[0].Message {
+		t.Fatal(err)
+	}
+}
+
+func TestReportExitCode(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "fsm.toml"), []byte(_DUPLICATE_TOML), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	output, err := _RunMain(t, dir, "-report", "json")
+	if err != nil || !strings.Contains(output, `"hasErrors": false`) {
+		t.Fatal("warnings alone should not fail", err, output)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "fsm_GEN.go")); !os.IsNotExist(err) {
+		t.Fatal("a report should not generate code", err)
+	}
+
+	toml := `EventStreamPolicy = "drop-newest"` + _DUPLICATE_TOML
+	if err := os.WriteFile(filepath.Join(dir, "fsm.toml"), []byte(toml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	output, err = _RunMain(t, dir, "-report", "json")
+	if err == nil || !strings.Contains(output, `"hasErrors": true`) {
+		t.Fatal("errors should fail", err, output)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+const SCHEMA_DIALECT = "https://json-schema.org/draft/2020-12/schema"
+
+// The closed set of values accepted by string options, by field name.
+var _SchemaEnums = map[string][]string{
+	"EventStreamPolicy": {"block", "drop-oldest"},
+	"UnknownEvent":      {"error", "ignore", "log"},
+}
+
+// The fields a definition can't be generated without, by struct type.
+var _SchemaRequired = map[reflect.Type][]string{
+	reflect.TypeFor[FSMDefinition]():       {"Name", "PackageName", "Events"},
+	reflect.TypeFor[FSMEventDefinition]():  {"Source", "Destination"},
+	reflect.TypeFor[FSMEventParams]():      {"Name", "Type"},
+	reflect.TypeFor[FSMField]():            {"Name", "Type"},
+	reflect.TypeFor[FSMRequirement]():      {"Provider", "State"},
+	reflect.TypeFor[FSMRegionDefinition](): {"InitialState"},
+}
+
+// BuildSchema describes the TOML definition as a JSON Schema, derived from
+// FSMDefinition so it can't drift from what ParseTOML accepts. Keys are
+// the Go field names, matched case-insensitively like the TOML decoder
+// does; fields tagged toml:"-" are set by flags and left out.
+func BuildSchema() map[string]any {
+	schema := _TypeSchema(reflect.TypeFor[FSMDefinition]())
+	schema["$schema"] = SCHEMA_DIALECT
+	schema["title"] = "FSM definition"
+	return schema
+}
+
+// _KeyPattern matches name in any letter case, e.g. ^[Nn][Aa][Mm][Ee]$.
+func _KeyPattern(name string) string {
+	pattern := strings.Builder{}
+	pattern.WriteRune('^')
+	for _, r := range name {
+		lower, upper := unicode.ToLower(r), unicode.ToUpper(r)
+		if lower == upper {
+			pattern.WriteString(regexp.QuoteMeta(string(r)))
+			continue
+		}
+		fmt.Fprintf(&pattern, "[%c%c]", upper, lower)
+	}
+	pattern.WriteRune('$')
+	return pattern.String()
+}
+
+func _TypeSchema(t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": _TypeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": _TypeSchema(t.Elem())}
+	case reflect.Struct:
+		properties := map[string]any{}
+		patterns := map[string]any{}
+		for i := range t.NumField() {
+			field := t.Field(i)
+			if !field.IsExported() || field.Tag.Get("toml") == "-" {
+				continue
+			}
+			property := _TypeSchema(field.Type)
+			if values, ok := _SchemaEnums[field.Name]; ok {
+				property["enum"] = values
+			}
+			properties[field.Name] = property
+			patterns[_KeyPattern(field.Name)] = property
+		}
+
+		schema := map[string]any{
+			"type":                 "object",
+			"properties":           properties,
+			"patternProperties":    patterns,
+			"additionalProperties": false,
+		}
+		// "required" only matches exact keys, so each required field is
+		// instead "not every key fails to match its pattern".
+		if required, ok := _SchemaRequired[t]; ok {
+			present := []any{}
+			for _, name := range required {
+				present = append(present, map[string]any{
+					"not": map[string]any{
+						"propertyNames": map[string]any{
+							"not": map[string]any{"pattern": _KeyPattern(name)},
+						},
+					},
+				})
+			}
+			schema["allOf"] = present
+		}
+		return schema
+	}
+
+	panic("no JSON Schema for " + t.String())
+}
+
+func RenderSchemaJSON() ([]byte, error) {
+	return json.MarshalIndent(BuildSchema(), "", "  ")
+}
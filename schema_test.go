@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+// _Normalise round trips v through JSON, so schemas and documents are made
+// of the same map[string]any, []any and float64 values.
+func _Normalise(t *testing.T, v any) any {
+	t.Helper()
+	raw, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var normalised any
+	if err := json.Unmarshal(raw, &normalised); err != nil {
+		t.Fatal(err)
+	}
+	return normalised
+}
+
+// _Validate checks value against the subset of JSON Schema BuildSchema
+// uses, returning where it first fails or "" when it is valid.
+func _Validate(schema map[string]any, value any, path string) string {
+	switch schema["type"] {
+	case "object":
+		if _, ok := value.(map[string]any); !ok {
+			return path + ": not an object"
+		}
+	case "array":
+		if _, ok := value.([]any); !ok {
+			return path + ": not an array"
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			return path + ": not a string"
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return path + ": not a boolean"
+		}
+	case "integer":
+		if number, ok := value.(float64); !ok || number != float64(int64(number)) {
+			return path + ": not an integer"
+		}
+	}
+
+	if enum, ok := schema["enum"].([]any); ok && !slices.Contains(enum, value) {
+		return fmt.Sprintf("%v: %v is not one of %v", path, value, enum)
+	}
+	if minimum, ok := schema["minimum"].(float64); ok && value.(float64) < minimum {
+		return fmt.Sprintf("%v: %v is less than %v", path, value, minimum)
+	}
+	if pattern, ok := schema["pattern"].(string); ok && !regexp.MustCompile(pattern).MatchString(value.(string)) {
+		return fmt.Sprintf("%v: %v does not match %v", path, value, pattern)
+	}
+
+	allOf, _ := schema["allOf"].([]any)
+	for _, sub := range allOf {
+		if failure := _Validate(sub.(map[string]any), value, path); failure != "" {
+			return failure
+		}
+	}
+	if not, ok := schema["not"].(map[string]any); ok && _Validate(not, value, path) == "" {
+		return path + ": matches a schema it must not"
+	}
+
+	if items, ok := schema["items"].(map[string]any); ok {
+		for i, item := range value.([]any) {
+			if failure := _Validate(items, item, fmt.Sprintf("%v[%v]", path, i)); failure != "" {
+				return failure
+			}
+		}
+	}
+
+	object, ok := value.(map[string]any)
+	if !ok {
+		return ""
+	}
+	properties, _ := schema["properties"].(map[string]any)
+	patterns, _ := schema["patternProperties"].(map[string]any)
+	for key, item := range object {
+		itemPath := path + "." + key
+		if names, ok := schema["propertyNames"].(map[string]any); ok {
+			if failure := _Validate(names, key, itemPath); failure != "" {
+				return failure
+			}
+		}
+
+		matched := false
+		if property, ok := properties[key]; ok {
+			matched = true
+			if failure := _Validate(property.(map[string]any), item, itemPath); failure != "" {
+				return failure
+			}
+		}
+		for pattern, property := range patterns {
+			if regexp.MustCompile(pattern).MatchString(key) {
+				matched = true
+				if failure := _Validate(property.(map[string]any), item, itemPath); failure != "" {
+					return failure
+				}
+			}
+		}
+
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !matched && !additional {
+				return itemPath + ": unknown key"
+			}
+		case map[string]any:
+			if !matched {
+				if failure := _Validate(additional, item, itemPath); failure != "" {
+					return failure
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func _ValidateTOML(t *testing.T, text string) string {
+	t.Helper()
+	var document any
+	if _, err := toml.Decode(text, &document); err != nil {
+		t.Fatal(err)
+	}
+	schema := _Normalise(t, BuildSchema()).(map[string]any)
+	return _Validate(schema, _Normalise(t, document), "$")
+}
+
+func TestSchemaAcceptsValidDefinitions(t *testing.T) {
+	sample, err := os.ReadFile("fsm.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, text := range map[string]string{
+		"fsm.toml": string(sample),
+		"orders":   _ORDER_TOML,
+		"regions":  _REGIONS_TOML,
+		"compact": `
+name = "Order"
+packageName = "orders"
+
+[events]
+approve = { source = ["Pending"], destination = "Approved" }
+ship = { source = ["Approved"], destination = "Shipped", params = [{ name = "carrier", type = "string" }] }
+`,
+	} {
+		if _, err := ParseTOML(strings.NewReader(text)); err != nil {
+			t.Fatal(name, err)
+		}
+		if failure := _ValidateTOML(t, text); failure != "" {
+			t.Fatal(name, failure)
+		}
+	}
+}
+
+func TestSchemaRejectsInvalidDefinitions(t *testing.T) {
+	for _, test := range []struct {
+		text string
+		want string
+	}{
+		{`Colour = "red"` + _ORDER_TOML, "$.Colour: unknown key"},
+		{`EventStreamPolicy = "drop-newest"` + _ORDER_TOML, "$.EventStreamPolicy: drop-newest is not one of [block drop-oldest]"},
+		{`UseSLog = "yes"` + _ORDER_TOML, "$.UseSLog: not a boolean"},
+		{_RETRY_TOML + "[States.Running]\nMaxVisits = -1\n", "$.States.Running.MaxVisits: -1 is less than 0"},
+		{strings.Replace(_ORDER_TOML, `Name = "Order"`, "", 1), "$: matches a schema it must not"},
+		{strings.Replace(_ORDER_TOML, `PackageName = "orders"`, "", 1), "$: matches a schema it must not"},
+		{_ORDER_TOML + "[Events.Hold]\nSource = [\"Pending\"]\n", "$.Events.Hold: matches a schema it must not"},
+	} {
+		if failure := _ValidateTOML(t, test.text); failure != test.want {
+			t.Fatalf("got %q, want %q for\n%v", failure, test.want, test.text)
+		}
+	}
+}
+
+func TestPackageNameRequired(t *testing.T) {
+	definition := _Parse(t, strings.Replace(_ORDER_TOML, `PackageName = "orders"`, "", 1))
+	err := ValidateDefinition(definition)
+	if err == nil || err.Error() != `PackageName "" is not a valid Go package name` {
+		t.Fatal(err)
+	}
+}
@@ -17,6 +17,74 @@ const(
 	%v State = iota
 `
 
+const EVENTS_DEF = `
+type Event %v
+
+const(
+	%v Event = iota
+`
+
+const EVENT_NAMES_DEF = `
+var _EVENT_NAMES = [...]string{
+	%v
+}
+
+// String returns the name the event was declared with, or Event(n) for
+// values outside the generated constants.
+func (e Event) String() string {
+	if int(e) >= len(_EVENT_NAMES) {
+		return fmt.Sprintf("Event(%%d)", e)
+	}
+	return _EVENT_NAMES[e]
+}
+`
+
+const EVENT_INDICES_DEF = `
+var _EVENT_INDICES = [...]Event{
+`
+
+const EVENT_INDICES_CHECK = `
+
+func init() {
+	for i, event := range _EVENT_INDICES {
+		if int(event) != i {
+			panic(fmt.Sprintf("event index %v found at position %v, event indices must be contiguous from 0", int(event), i))
+		}
+	}
+}
+`
+
+const STATE_IS_VALID_DEF = `
+
+// IsValid reports whether s is one of the machine's real states, which
+// excludes the reserved zero state.
+func (s State) IsValid() bool {
+	_, ok := FSM_STATE_NAME_LOOKUP[s]
+	return ok
+}
+`
+
+const STRINGER_DEF = `
+
+func _() {
+	// An "invalid array index" compiler error signifies that the constant values have changed.
+	// Re-run the stringer command to generate them again.
+	var x [1]struct{}
+	%v
+}
+
+const _State_name = "%v"
+
+var _State_index = [...]%v{%v}
+
+func (i State) String() string {
+	if i >= State(len(_State_index)-1) {
+		return "State(" + strconv.FormatInt(int64(i), 10) + ")"
+	}
+	return _State_name[_State_index[i]:_State_index[i+1]]
+}
+`
+
 var a = map[int]string{
 	0: "a",
 }
@@ -26,38 +94,660 @@ var FSM_STATE_NAME_LOOKUP = map[State]string{
 `
 
 const FSM_DEF = `
-type %vFSM struct {
+type %vFSM%v struct {
 	State State
-	_Hooks map[%v]any
+	_Hooks map[Event]any
+	%v
 }
 `
 
 const EVENT = `
-type Event%vHook func(%v)
+type Event%vHook%v func(%v)
 
-func (fsm *%vFSM) %v(%v) error {
-	switch fsm.State {
+// %v is valid from: %v. Transitions to: %v.
+func (fsm *%v) %v(%v) %v {
+	%v
+	switch fsm.%v {
 	case %v:
 	default:
-		return fmt.Errorf("attempted to invoke event %v from invalid state: %v", fsm.State)
+		return %vfmt.Errorf("attempted to invoke event %v from invalid state: %v", fsm.%v)
 	}
 	%v
-	hook := fsm._Hooks[%v].(Event%vHook)
+	%v
+	hook := fsm._Hooks[%v].(Event%vHook%v)
 	hook(%v)
-	fsm.State = %v
-	return nil
+	%v
+	fsm.%v = %v
+	%v
+	return %v
 }
 
-func (fsm *%vFSM) Set%vHook(hook Event%vHook) {
+func (fsm *%v) Set%vHook(hook Event%vHook%v) {
 	fsm._Hooks[%v] = hook
 }
 `
 
 const INIT = `
-func NewFSM(startState State) *%vFSM {
-	return &%vFSM{
-		startState,
-		map[%v]any{},
+func NewFSM%v(startState State%v) *%v {
+	return &%v{
+		State: startState,
+		_Hooks: map[Event]any{},
+		%v
+	}
+}
+`
+
+const STATE_FROM_STRING_DEF = `
+// StateFromString looks up a State by its name in FSM_STATE_NAME_LOOKUP.
+func StateFromString(name string) (State, bool) {
+	for state, stateName := range FSM_STATE_NAME_LOOKUP {
+		if stateName == name {
+			return state, true
+		}
+	}
+	return 0, false
+}
+`
+
+const DEFAULT_EVENT_STREAM_BUFFER = 16
+
+const EVENT_STREAM_DEF = `
+type Transition struct {
+	Event Event
+	From  State
+	To    State
+}
+
+// Events returns a channel receiving every successful transition in order.
+// The channel is closed by StopEvents.
+func (fsm *%v) Events() <-chan Transition {
+	return fsm._Events
+}
+
+// StopEvents closes the channel returned by Events. Transitions made
+// afterwards are no longer published.
+func (fsm *%v) StopEvents() {
+	if fsm._EventsClosed {
+		return
+	}
+	fsm._EventsClosed = true
+	close(fsm._Events)
+}
+
+func (fsm *%v) _Publish(t Transition) {
+	if fsm._EventsClosed {
+		return
+	}
+	%v
+}
+`
+
+const EVENT_STREAM_BLOCK = `fsm._Events <- t`
+
+const EVENT_STREAM_DROP_OLDEST = `for {
+		select {
+		case fsm._Events <- t:
+			return
+		default:
+		}
+		select {
+		case <-fsm._Events:
+		default:
+		}
+	}`
+
+const APPLY_ALL_DEF = `
+type EventCall struct {
+	Event  Event
+	Params []any
+}
+
+// ApplyAll fires each call in order and stops at the first failure.
+func (fsm *%v) ApplyAll(events []EventCall) error {
+	%v
+	for i, call := range events {
+		if err := fsm._Apply(call); err != nil {
+			%v
+			return fmt.Errorf("batch event %%v failed: %%w", i, err)
+		}
+	}
+	return nil
+}
+
+func (fsm *%v) _Apply(call EventCall) error {
+	switch call.Event {
+	%v
+	default:
+		return fmt.Errorf("unknown event %%v", call.Event)
+	}
+}
+`
+
+const PAYLOAD_DEF = `
+// EventPayload is implemented by the <Event>Payload struct of every event,
+// so events can be passed around as values and fired with Handle.
+type EventPayload interface {
+	eventName() string
+}
+
+// Handle fires the event the payload belongs to with its fields as params.
+func (fsm *%v) Handle(e EventPayload) error {
+	switch e := e.(type) {
+	%v
+	default:
+		return fmt.Errorf("unknown event payload %%T", e)
+	}
+}
+`
+
+const PAYLOAD_STRUCT_DEF = `
+// %vPayload carries the params of %v.
+type %vPayload struct {
+	%v
+}
+
+func (%vPayload) eventName() string {
+	return %q
+}
+`
+
+const MACHINE_DEF = `
+var Machine = map[State]map[Event]State{
+`
+
+const MACHINE_APPLY = `
+// Apply looks up the destination of firing e from s in Machine.
+func Apply(s State, e Event) (State, error) {
+	dest, ok := Machine[s][e]
+	if !ok {
+		return s, fmt.Errorf("event %v is not valid from state %v", e, s)
+	}
+	return dest, nil
+}
+`
+
+const MAX_VISITS_DEF = `
+// ErrMaxVisits is returned when an event would enter a state that has
+// already been entered its MaxVisits times.
+var ErrMaxVisits = errors.New("state visit limit reached")
+`
+
+const JSON_DEF = `
+type _%vFSMJSON struct {
+	State string
+	%v
+}
+
+func (fsm *%v) MarshalJSON() ([]byte, error) {
+	data := _%vFSMJSON{State: FSM_STATE_NAME_LOOKUP[fsm.State]}
+	%v
+	return json.Marshal(data)
+}
+
+func (fsm *%v) UnmarshalJSON(b []byte) error {
+	data := _%vFSMJSON{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	state, ok := StateFromString(data.State)
+	if !ok {
+		return fmt.Errorf("unknown state %%q", data.State)
+	}
+	%v
+
+	// Unmarshalling into a zero FSM leaves it as usable as one from NewFSM.
+	if fsm._Hooks == nil {
+		fsm._Hooks = map[Event]any{}
+	}
+	%v
+	fsm.State = state
+	return nil
+}
+`
+
+const JSON_MARSHAL_VISITS = `data.Visits = map[string]uint{}
+	for state, count := range fsm.Visits {
+		data.Visits[FSM_STATE_NAME_LOOKUP[state]] = count
+	}
+`
+
+const JSON_UNMARSHAL_VISITS = `visits := map[State]uint{}
+	for name, count := range data.Visits {
+		visited, ok := StateFromString(name)
+		if !ok {
+			return fmt.Errorf("unknown state %q in visits", name)
+		}
+		visits[visited] = count
+	}
+	fsm.Visits = visits
+`
+
+const JSON_MARSHAL_FIRED_GROUPS = `for _, name := range []string{%v} {
+		if fsm._FiredGroups[name] {
+			data.FiredGroups = append(data.FiredGroups, name)
+		}
+	}
+`
+
+const JSON_UNMARSHAL_FIRED_GROUPS = `firedGroups := map[string]bool{}
+	for _, name := range data.FiredGroups {
+		switch name {
+		case %v:
+		default:
+			return fmt.Errorf("unknown group %%q in fired groups", name)
+		}
+		firedGroups[name] = true
+	}
+	fsm._FiredGroups = firedGroups
+`
+
+const PAUSE_DEF = `
+// ErrPaused is returned by every event method while the FSM is paused.
+var ErrPaused = errors.New("fsm is paused")
+
+// Pause makes every event method fail with ErrPaused until Resume.
+func (fsm *%v) Pause() {
+	fsm._Paused = true
+}
+
+func (fsm *%v) Resume() {
+	fsm._Paused = false
+}
+
+func (fsm *%v) Paused() bool {
+	return fsm._Paused
+}
+`
+
+const DONE_CALLBACK_DEFER = `if done != nil {
+		defer func() {
+			done(fsm.%v, err)
+		}()
+	}
+`
+
+const RESET_REGION_DEF = `
+// ResetRegion%v returns the %v region to its InitialState %v, leaving
+// State and the other regions alone.
+func (fsm *%v) ResetRegion%v() {
+	fsm.%v = %v
+}
+`
+
+const CURRENT_STATE_DEF = `
+// _CurrentState returns the current state of the main machine or region
+// that s belongs to.
+func (fsm *%v) _CurrentState(s State) State {
+	switch s {
+	%v
 	}
+	return fsm.State
 }
 `
+
+const EXPECT_STATE_DEF = `
+// ExpectState returns an error naming both states when the FSM is not in want.
+func (fsm *%v) ExpectState(want State) error {
+	got := %v
+	if got == want {
+		return nil
+	}
+	return fmt.Errorf("got %%v, want %%v", _FormatState(got), _FormatState(want))
+}
+
+func _FormatState(s State) string {
+	if name, ok := FSM_STATE_NAME_LOOKUP[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("State(%%v)", uint64(s))
+}
+`
+
+const REGISTRY_IMPORT = "github.com/j4d3blooded/go-fsm-codegen/fsmregistry"
+
+const REGISTER_DEF = `
+// _RegistryAnchor gives the registry this package's import path.
+type _RegistryAnchor struct{}
+
+func init() {
+	fsmregistry.Register(fsmregistry.Info{
+		Name:    %q,
+		Package: %q,
+		Path:    reflect.TypeOf(_RegistryAnchor{}).PkgPath(),
+		States:  []string{%v},
+		Events:  []string{%v},
+	})
+}
+`
+
+const WOULD_CHANGE_DEF = `
+// WouldChange reports whether firing the named event now is valid and moves
+// the FSM to a different state, so self-transitions report false.
+func (fsm *%v) WouldChange(event string) bool {
+	switch event {
+	%v
+	}
+	return false
+}
+`
+
+const DEFAULTS_WRAPPER_DEF = `
+// %vWithDefaults calls %v, filling params declared with From from the
+// FSM's fields.
+func (fsm *%v) %vWithDefaults(%v) %v {
+	return fsm.%v(%v)
+}
+`
+
+const STRING_TABLE_DEF = `
+// StringTable maps source state name to event name to destination state
+// name, for driving the machine from scripting layers.
+var StringTable = map[string]map[string]string{
+`
+
+const TRANSITION_VETO_DEF = `
+// ErrTransitionVetoed is returned when CanTransition rejects a transition
+// without giving an error of its own.
+var ErrTransitionVetoed = errors.New("transition vetoed")
+`
+
+const CAN_TRANSITION_CHECK = `if fsm.CanTransition != nil {
+	if allowed, vetoErr := fsm.CanTransition(fsm.%v, %v, %q); vetoErr != nil {
+		return %vvetoErr
+	} else if !allowed {
+		return %vfmt.Errorf("%%w: %v", ErrTransitionVetoed)
+	}
+}
+`
+
+const GROUP_LOCKED_DEF = `
+// ErrGroupLocked is returned when another event of the same group has
+// already fired since the group was last reset.
+var ErrGroupLocked = errors.New("event group already fired")
+`
+
+const STATE_PROVIDER_DEF = `
+// StateProvider exposes another machine's current state by name, for
+// events that require it to be in a particular state.
+type StateProvider interface {
+	CurrentState() string
+}
+
+// ErrPreconditionFailed is returned when a required StateProvider is
+// missing or not in the required state.
+var ErrPreconditionFailed = errors.New("precondition failed")
+`
+
+const TEST_HEADER = `// Code generated by go generate; DO NOT EDIT.
+
+package %v
+
+import (
+	"fmt"
+	"testing"
+`
+
+const LOOKUP_TEST_DEF = `
+
+func TestStateNameLookupComplete(t *testing.T) {
+	states := []State{%v}
+	if len(FSM_STATE_NAME_LOOKUP) != len(states) {
+		t.Errorf("FSM_STATE_NAME_LOOKUP has %%v entries, want %%v", len(FSM_STATE_NAME_LOOKUP), len(states))
+	}
+	for _, state := range states {
+		if _, ok := FSM_STATE_NAME_LOOKUP[state]; !ok {
+			t.Errorf("state %%v is missing from FSM_STATE_NAME_LOOKUP", uint64(state))
+		}
+	}
+}
+`
+
+const SCENARIO_DEF = `
+
+// Scenario drives an FSM through events in a Given/When/Then style,
+// failing the test at the first step that doesn't hold.
+type Scenario struct {
+	T   testing.TB
+	FSM *%v
+}
+
+// Given starts a scenario from state, with zero valued fields and a no-op
+// hook set for every event.
+func Given(t testing.TB, state State) *Scenario {
+	fsm := NewFSM(state%v)
+	%v
+	return &Scenario{t, fsm}
+}
+
+// When fires the named event with params, failing the test if it errors.
+func (s *Scenario) When(event string, params ...any) *Scenario {
+	s.T.Helper()
+	if err := s._Fire(event, params); err != nil {
+		s.T.Fatalf("When(%%q): %%v", event, err)
+	}
+	return s
+}
+
+// Then fails the test unless the FSM is in want.
+func (s *Scenario) Then(want State) *Scenario {
+	s.T.Helper()
+	if got := %v; got != want {
+		s.T.Fatalf("got %%v, want %%v", FSM_STATE_NAME_LOOKUP[got], FSM_STATE_NAME_LOOKUP[want])
+	}
+	return s
+}
+
+func (s *Scenario) _Fire(event string, params []any) error {
+	switch event {
+	%v
+	default:
+		return fmt.Errorf("unknown event %%q", event)
+	}
+}
+`
+
+const DISPATCHER_DEF = `
+// Fire calls the event method named event, matched case-insensitively,
+// type-asserting params to the event's declared param types.
+func (fsm *%v) Fire(event string, params ...any) error {
+	switch strings.ToLower(event) {
+	%v
+	default:
+		%v
+	}
+}
+`
+
+const UNKNOWN_EVENT_DEF = `
+// ErrUnknownEvent is returned by Fire for event names not in the machine.
+var ErrUnknownEvent = errors.New("unknown event")
+`
+
+const UNKNOWN_EVENT_ERROR = `return fmt.Errorf("%w: %q", ErrUnknownEvent, event)`
+
+const UNKNOWN_EVENT_IGNORE = `return nil`
+
+const UNKNOWN_EVENT_LOG = `slog.Warn("Ignoring unknown event", "Event", event)
+		return nil`
+
+const REACHABLE_FINAL_STATES_DEF = `
+var _REACHABLE_FINAL_STATES = map[State][]State{
+	%v
+}
+
+// ReachableFinalStates lists the FinalStates that can still be reached
+// from the current state of the machine and of each region, including the
+// current states themselves.
+func (fsm *%v) ReachableFinalStates() []State {
+	var finals []State
+	for _, current := range []State{%v} {
+		finals = append(finals, _REACHABLE_FINAL_STATES[current]...)
+	}
+	return finals
+}
+`
+
+const STATE_INFO_DEF = `
+// StateInfo is the metadata a state was declared with.
+type StateInfo struct {
+	Name    string
+	Display string
+	Doc     string
+	Tags    []string
+	Final   bool
+}
+
+var _STATE_INFO = map[State]StateInfo{
+	%v
+}
+
+// StateInfo returns the metadata of the current state.
+func (fsm *%v) StateInfo() StateInfo {
+	info := _STATE_INFO[fsm.State]
+	info.Tags = append([]string(nil), info.Tags...)
+	return info
+}
+`
+
+const ALL_EVENTS_DEF = `
+// EventParam is a param an event method takes, with its Go type.
+type EventParam struct {
+	Name string
+	Type string
+}
+
+// EventInfo describes an event as it was declared.
+type EventInfo struct {
+	Name        string
+	Sources     []string
+	Destination string
+	Params      []EventParam
+	Doc         string
+}
+
+// AllEvents describes every event, sorted by name.
+func AllEvents() []EventInfo {
+	return []EventInfo{
+		%v
+	}
+}
+`
+
+const GO_TO_DEF = `
+// GoTo fires the one event valid from the current state that leads to the
+// named state. It fails when no event or more than one does.
+func (fsm *%v) GoTo(stateName string) error {
+	target, ok := StateFromString(stateName)
+	if !ok {
+		return fmt.Errorf("unknown state %%q", stateName)
+	}
+
+	switch fsm.State {
+	%v
+	}
+	return fmt.Errorf("no event leads from %%v to %%v", FSM_STATE_NAME_LOOKUP[fsm.State], stateName)
+}
+`
+
+const PATH_EVENTS_DEF = `
+type _Edge struct {
+	Event string
+	To    State
+}
+
+var _EDGES = map[State][]_Edge{
+	%v
+}
+
+var (
+	_PathEventsMu    sync.Mutex
+	_PathEventsCache = map[[2]State][]string{}
+)
+
+// PathEvents returns the shortest sequence of event names leading from one
+// state to another, and false when to can't be reached from from.
+func PathEvents(from, to State) ([]string, bool) {
+	_PathEventsMu.Lock()
+	defer _PathEventsMu.Unlock()
+
+	key := [2]State{from, to}
+	if path, ok := _PathEventsCache[key]; ok {
+		return append([]string(nil), path...), path != nil
+	}
+
+	type step struct {
+		state State
+		path  []string
+	}
+
+	var found []string
+	visited := map[State]bool{from: true}
+	queue := []step{{from, []string{}}}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if current.state == to {
+			found = current.path
+			break
+		}
+		for _, edge := range _EDGES[current.state] {
+			if !visited[edge.To] {
+				visited[edge.To] = true
+				path := append(append([]string{}, current.path...), edge.Event)
+				queue = append(queue, step{edge.To, path})
+			}
+		}
+	}
+
+	_PathEventsCache[key] = found
+	return append([]string(nil), found...), found != nil
+}
+`
+
+const MAP_WRAPPER_DEF = `
+// %vMap calls %v with params looked up by name in m, failing when one is
+// missing or has the wrong type.
+func (fsm *%v) %vMap(m map[string]any) error {
+	%v
+}
+`
+
+const SQL_DEF = `
+// Scan implements sql.Scanner, reading a State from its name in a string
+// or []byte column.
+func (s *State) Scan(src any) error {
+	var name string
+	switch value := src.(type) {
+	case nil:
+		%v
+	case string:
+		name = value
+	case []byte:
+		name = string(value)
+	default:
+		return fmt.Errorf("cannot scan %%T into State", src)
+	}
+
+	state, ok := StateFromString(name)
+	if !ok {
+		return fmt.Errorf("unknown state %%q", name)
+	}
+	*s = state
+	return nil
+}
+
+// Value implements driver.Valuer, storing a State as its name.
+func (s State) Value() (driver.Value, error) {
+	name, ok := FSM_STATE_NAME_LOOKUP[s]
+	if !ok {
+		return nil, fmt.Errorf("cannot store invalid state %%v", uint64(s))
+	}
+	return name, nil
+}
+`
+
+const SQL_SCAN_NULL_ERROR = `return fmt.Errorf("cannot scan NULL into State")`
+
+const SQL_SCAN_NULL_UNSPECIFIED = `*s = 0
+		return nil`